@@ -16,8 +16,8 @@ func main() {
 		log.Fatal(err)
 	}
 	server := NewServer(templateLoader)
-	http.Handle("/", server)
-	err = http.ListenAndServe(":8080", nil)
+	http.Handle("/", webs.NewStartTimeHandler(server, webs.SystemClock))
+	err = webs.Serve(&http.Server{Addr: ":8080"}, 10*time.Second, server.sessionStore)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -25,36 +25,29 @@ func main() {
 
 // Server is a http.Handler that serves incoming HTTP requests.
 type Server struct {
-	responseRenderer *webs.ResponseRenderer
-	sessionStore     webs.SessionStore
+	router       *webs.Router
+	sessionStore webs.SessionStore
+	sessions     *webs.SessionManager
 }
 
 func NewServer(templateLoader webs.TemplateLoader) *Server {
 	responseRenderer := webs.NewResponseRenderer(templateLoader)
+	responseRenderer.AccessLog = func(e webs.AccessLogEntry) {
+		log.Printf("[webs] %-4s %-20s %d - %s", e.Request.Method, e.Request.URL.Path, e.StatusCode, e.Duration)
+	}
 	sessionStore := webs.NewMemorySessionStore()
-	return &Server{responseRenderer, sessionStore}
+	sessions := webs.NewSessionManager(sessionStore, sessionIdCookieName, 24*time.Hour)
+	s := &Server{webs.NewRouter(responseRenderer), sessionStore, sessions}
+	s.router.Handle("/", s.servIndex)
+	s.router.Handle("GET /say", s.servSay)
+	s.router.Handle("/add", s.servAdd)
+	return s
 }
 
 // ServeHTTP implements http.Handler and dispatches requests to serv methods.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	// wrap http.Request in webs.Request
-	req := webs.NewRequest(r)
-	// call serv() method based on path
-	var res webs.Response
-	switch r.URL.Path {
-	case "/":
-		res = s.servIndex(req)
-	case "/say":
-		res = s.servSay(req)
-	case "/add":
-		res = s.servAdd(req)
-	}
-	// render response (or 404)
-	s.responseRenderer.Render(w, r, res)
-	// log request
-	latency := time.Since(start)
-	log.Printf("[webs] %-4s %-20s  - %s", r.Method, r.URL.Path, latency)
+	// call serv() method based on method and path, render and log response (or 404)
+	s.router.ServeHTTP(w, r)
 }
 
 const (
@@ -62,23 +55,12 @@ const (
 )
 
 func (s *Server) servIndex(req webs.Request) webs.Response {
-	sessionId := req.CookieValue(sessionIdCookieName, "")
-	session := s.sessionStore.Find(sessionId)
 	if req.IsPost() {
-		if session.IsZero() {
-			session = webs.NewSession()
-		}
-		session = session.WithValue("name", req.PostForm("name"))
-		if err := s.sessionStore.Save(session); err != nil {
-			return webs.NewStatusInternalServerErrorResponse("cannot save session: %s", err)
-		}
-		res := webs.NewRedirectResponse("/")
-		if sessionId != session.Id() {
-			res = res.WithCookie(sessionIdCookieName, session.Id(), 24*time.Hour)
-		}
-		return res
+		return s.sessions.Update(req, webs.NewRedirectResponse("/"), func(session webs.Session) webs.Session {
+			return session.WithValue("name", req.PostForm("name"))
+		})
 	}
-	name := session.Get("name", "")
+	name := s.sessions.Find(req).Get("name", "")
 	res := webs.NewTemplateResponse("index.html", webs.M{
 		"name": name,
 	})
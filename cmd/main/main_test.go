@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"net/http/httptest"
 	"testing"
 	"webs"
 )
@@ -10,11 +10,7 @@ func Test(t *testing.T) {
 	s := NewServer(webs.NewNullTemplateLoader())
 	// test "GET /say?message=hello"
 	{
-		req := &fakeRequest{
-			query: map[string]string{
-				"message": "hello",
-			},
-		}
+		req := webs.NewTestRequest("GET", "/say?message=hello")
 		res := s.servSay(req)
 		assertEq(t, webs.TemplateResponse, res.Type)
 		assertEq(t, "say.html", res.TemplateName)
@@ -23,7 +19,7 @@ func Test(t *testing.T) {
 	}
 	// test "GET /add"
 	{
-		req := &fakeRequest{}
+		req := webs.NewTestRequest("GET", "/add")
 		res := s.servAdd(req)
 		assertEq(t, webs.TemplateResponse, res.Type)
 		assertEq(t, "add.html", res.TemplateName)
@@ -34,10 +30,7 @@ func Test(t *testing.T) {
 	}
 	// test "POST /add" with formdata value1=13&value2=29
 	{
-		req := &fakeRequest{post: true, postForm: map[string]string{
-			"value1": "13",
-			"value2": "29",
-		}}
+		req := webs.NewTestRequest("POST", "/add").WithPostForm("value1", "13").WithPostForm("value2", "29")
 		res := s.servAdd(req)
 		assertEq(t, webs.TemplateResponse, res.Type)
 		assertEq(t, "add.html", res.TemplateName)
@@ -46,33 +39,24 @@ func Test(t *testing.T) {
 		assertEq(t, 29, res.TemplateData["value2"])
 		assertEq(t, 42, res.TemplateData["result"])
 	}
-}
-
-// fake webs.Request
-
-type fakeRequest struct {
-	post     bool
-	query    map[string]string
-	postForm map[string]string
-}
-
-func (f *fakeRequest) IsPost() bool {
-	return f.post
-}
-func (f *fakeRequest) Query(name string) string {
-	return f.query[name]
-}
-
-func (f *fakeRequest) PostForm(name string) string {
-	return f.postForm[name]
-}
-
-func (f *fakeRequest) FormFile(name string) (webs.FormFile, error) {
-	return nil, fmt.Errorf("FormFile() not implemented in fakeRequest")
-}
-
-func (f *fakeRequest) CookieValue(name, defValue string) string {
-	return defValue
+	// test "POST /" with formdata name=joe
+	{
+		req := webs.NewTestRequest("POST", "/").WithPostForm("name", "joe")
+		rec := webs.NewResponseRenderer(webs.NewNullTemplateLoader()).Record(req.HttpRequest(), s.servIndex(req))
+		assertEq(t, nil, rec.AssertRedirect("/"))
+		cookie := rec.Cookie(sessionIdCookieName)
+		assertEq(t, true, cookie != nil)
+		// test "GET /" with the session cookie
+		res := s.servIndex(webs.NewTestRequest("GET", "/").WithCookie(cookie.Name, cookie.Value))
+		assertEq(t, "index.html", res.TemplateName)
+		assertEq(t, "joe", res.TemplateData["name"])
+	}
+	// test "POST /say" is not routed
+	{
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/say", nil))
+		assertEq(t, 405, w.Code)
+	}
 }
 
 // assertion helper
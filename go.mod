@@ -1,3 +1,5 @@
 module webs
 
 go 1.20
+
+require golang.org/x/crypto v0.21.0
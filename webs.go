@@ -9,32 +9,159 @@ package webs
 // ----------------------------------------------------------------------------
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
-	"math/rand"
+	"io/fs"
+	"log"
+	"math"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // Request represents a HTTP request.
 type Request interface {
+	// Method returns the HTTP method, e.g. "GET".
+	Method() string
+	// IsGet returns true if this is a GET request.
+	IsGet() bool
 	// IsPost returns true if this is a POST request.
 	IsPost() bool
+	// IsPut returns true if this is a PUT request.
+	IsPut() bool
+	// IsPatch returns true if this is a PATCH request.
+	IsPatch() bool
+	// IsDelete returns true if this is a DELETE request.
+	IsDelete() bool
 	// Query returns first named query parameter, or empty string if not found.
 	Query(name string) string
+	// RawQuery returns the query string exactly as received, without the '?'.
+	// Use it e.g. for signature verification, where re-encoding would change the bytes.
+	RawQuery() string
+	// QueryInt returns first named query parameter as int, or defValue if not found or not a valid int.
+	QueryInt(name string, defValue int) int
+	// QueryBool returns first named query parameter as bool, or defValue if not found or not a valid bool.
+	// The values "1", "true", "on" and "yes" are true, "0", "false", "off" and "no" are false (case-insensitive).
+	QueryBool(name string, defValue bool) bool
 	// PostForm returns first named form post parameter, or empty string if not found.
 	PostForm(name string) string
+	// PostFormAll returns all named form post parameters, or an empty slice if not found.
+	PostFormAll(name string) []string
 	// FormFile returns the first file for the provided form key.
+	// It returns ErrBodyTooLarge if the request body is larger than MaxUploadSize.
 	FormFile(name string) (FormFile, error)
+	// BindJSON decodes the JSON request body into v, which must be a pointer.
+	// The request must have content type application/json and the body
+	// must not be larger than MaxJsonBodySize and must contain exactly one JSON value.
+	BindJSON(v any) error
+	// BindQuery sets the fields of the struct that v points to from query
+	// parameters. Fields are bound by tag, e.g. `query:"page"`, untagged fields
+	// are ignored. Fields keep their value if the parameter is missing or empty,
+	// so defaults are set before calling BindQuery. Supported field types are
+	// string, bool, int, uint and float types, time.Time in RFC 3339,
+	// "2006-01-02T15:04" or "2006-01-02" format, and slices of these
+	// for repeated parameters. Errors name the offending field.
+	BindQuery(v any) error
+	// BindForm sets the fields of the struct that v points to from the
+	// urlencoded or multipart form of a POST, PUT or PATCH request, like
+	// BindQuery but with tags like `form:"name"`. Fields of type FormFile or
+	// []FormFile are set to uploaded files, which must be closed by the caller.
+	// Missing and empty form fields leave the struct field unchanged, so a
+	// required field can be detected by its zero value: if v implements
+	// interface{ Validate() error }, Validate is called after binding and
+	// its error is returned.
+	// It returns ErrBodyTooLarge if the request body is larger than MaxUploadSize.
+	BindForm(v any) error
+	// IsSecure returns true if the request was made over TLS, either directly
+	// or through a trusted proxy that sets X-Forwarded-Proto: https, where only
+	// the rightmost entry, which the proxy has added, counts.
+	// See SetTrustedProxies.
+	IsSecure() bool
+	// Scheme returns "https" if IsSecure returns true, otherwise "http".
+	Scheme() string
+	// Host returns the host, with port if not the default, that the client
+	// requested, e.g. "example.com". Behind a trusted proxy, it is taken from
+	// the rightmost X-Forwarded-Host entry, which the proxy has added, if
+	// present. Use Scheme() + "://" + Host() to build
+	// absolute URLs of the app, e.g. for links in emails.
+	Host() string
+	// RemoteIP returns the IP address of the client. By default, this is the
+	// address of the TCP peer. If the peer is a trusted proxy, it is the rightmost
+	// address in X-Forwarded-For that is not a trusted proxy, or X-Real-IP if
+	// there is no X-Forwarded-For header. See SetTrustedProxies.
+	RemoteIP() string
+	// StartTime returns the time when the request was received, as recorded by
+	// NewStartTimeHandler, or zero time if not recorded.
+	StartTime() time.Time
+	// CspNonce returns the request's CSP nonce, as created by
+	// NewCspNonceHandler, or empty string if there is none.
+	CspNonce() string
 	// CookieValue returns the named cookie, or empty string if not found.
 	CookieValue(name, defValue string) string
+	// Cookies returns all cookies of the request, in the order they were sent.
+	Cookies() []*http.Cookie
+	// Header returns the first value of the named request header, or empty string if not found.
+	// The name is case-insensitive.
+	Header(name string) string
+	// HeaderValues returns all values of the named request header, or nil if not found.
+	// The name is case-insensitive.
+	HeaderValues(name string) []string
+	// HasHeader returns true if the named request header is present, even if its value is empty.
+	// The name is case-insensitive.
+	HasHeader(name string) bool
+	// PreferredLanguage returns the language in supported, e.g. []string{"en", "de-CH"},
+	// that best matches the Accept-Language header, or supported[0] if none matches.
+	// A language range matches a language tag if it is equal, or a prefix of it
+	// ("de" matches "de-CH"), or vice versa ("de-AT" matches "de"), or "*".
+	// The highest quality wins; for equal quality, the more exact match, and then
+	// the order in supported.
+	PreferredLanguage(supported []string) string
+	// BasicAuth returns the username and password of the Authorization header
+	// for HTTP Basic Authentication, see NewBasicAuthChallengeResponse.
+	BasicAuth() (username, password string, ok bool)
+	// BearerToken returns the token of an "Authorization: Bearer <token>" header,
+	// or empty string if the header is missing or has another scheme.
+	// The scheme is case-insensitive.
+	BearerToken() string
+	// IsHtmx returns true if the request was made by htmx, i.e. it has the header "HX-Request: true".
+	IsHtmx() bool
+	// Param returns the named path parameter captured by a Router,
+	// e.g. "id" for route "/user/:id", or empty string if not found.
+	Param(name string) string
+	// Context returns the context of the request. It is canceled when the
+	// client goes away, use it for downstream I/O like database queries.
+	Context() context.Context
 }
 
 // FormFile represents a HTTP file upload.
@@ -49,6 +176,99 @@ type FormFile interface {
 	Close() error
 }
 
+// MaxJsonBodySize is the maximum size in bytes of a request body that is
+// accepted by Request.BindJSON.
+var MaxJsonBodySize int64 = 1 << 20
+
+// MaxUploadSize is the maximum size in bytes of a multipart request body that is
+// accepted by Request.FormFile.
+var MaxUploadSize int64 = 32 << 20
+
+// ErrBodyTooLarge is returned if a request body is larger than allowed.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// trustedProxies holds the networks of reverse proxies whose
+// X-Forwarded-* headers are trusted.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the networks of reverse proxies, in CIDR notation
+// like "10.0.0.0/8", whose X-Forwarded-* headers are trusted.
+// By default, no proxy is trusted. Call it once at startup before serving
+// requests, it is not safe for concurrent use.
+func SetTrustedProxies(cidrs ...string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("cannot parse trusted proxy: %w", err)
+		}
+		nets = append(nets, ipnet)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// isTrustedProxy returns true if remoteAddr, in the form "host:port" or "host",
+// belongs to a trusted proxy.
+func isTrustedProxy(remoteAddr string) bool {
+	return isTrustedIP(net.ParseIP(remoteHost(remoteAddr)))
+}
+
+// isTrustedIP returns true if ip belongs to a trusted proxy.
+func isTrustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host of remoteAddr, in the form "host:port" or "host".
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// contextKey is the type of request context keys used by webs.
+type contextKey int
+
+const (
+	startTimeKey contextKey = iota
+	cspNonceKey
+	paramsKey
+)
+
+// NewStartTimeHandler returns a http.Handler that records the current time
+// in the request context before calling next, see Request.StartTime.
+func NewStartTimeHandler(next http.Handler, clock Clock) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), startTimeKey, clock.Now())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NewCspNonceHandler returns a http.Handler that generates a random nonce
+// for each request and sets the Content-Security-Policy header before calling next.
+// All occurrences of "{nonce}" in policy are replaced with the nonce, e.g.
+// "script-src 'nonce-{nonce}'". Handlers get the nonce with Request.CspNonce,
+// templates with the cspNonce func: <script nonce="{{cspNonce}}">.
+// Note that templates are copied for each request to provide cspNonce.
+func NewCspNonceHandler(next http.Handler, policy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := GenerateToken(16)
+		w.Header().Set("Content-Security-Policy", strings.ReplaceAll(policy, "{nonce}", nonce))
+		ctx := context.WithValue(r.Context(), cspNonceKey, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // requestImpl is a Request that wraps a *http.Request.
 type requestImpl struct {
 	r *http.Request
@@ -60,10 +280,30 @@ func NewRequest(r *http.Request) Request {
 	return &requestImpl{r}
 }
 
+func (r *requestImpl) Method() string {
+	return r.r.Method
+}
+
+func (r *requestImpl) IsGet() bool {
+	return r.r.Method == "GET"
+}
+
 func (r *requestImpl) IsPost() bool {
 	return r.r.Method == "POST"
 }
 
+func (r *requestImpl) IsPut() bool {
+	return r.r.Method == "PUT"
+}
+
+func (r *requestImpl) IsPatch() bool {
+	return r.r.Method == "PATCH"
+}
+
+func (r *requestImpl) IsDelete() bool {
+	return r.r.Method == "DELETE"
+}
+
 func (r *requestImpl) Query(name string) string {
 	valuesMap := r.r.URL.Query()
 	values := valuesMap[name]
@@ -73,11 +313,40 @@ func (r *requestImpl) Query(name string) string {
 	return values[0]
 }
 
+func (r *requestImpl) RawQuery() string {
+	return r.r.URL.RawQuery
+}
+
+func (r *requestImpl) QueryInt(name string, defValue int) int {
+	return parseInt(r.Query(name), defValue)
+}
+
+func (r *requestImpl) QueryBool(name string, defValue bool) bool {
+	return parseBool(r.Query(name), defValue)
+}
+
 func (r *requestImpl) PostForm(name string) string {
-	return r.r.PostFormValue(name)
+	if r.r.PostForm == nil {
+		parsePostForm(r.r) // same as http.Request.PostFormValue, errors are ignored
+	}
+	return r.r.PostForm.Get(name)
+}
+
+func (r *requestImpl) PostFormAll(name string) []string {
+	if r.r.PostForm == nil {
+		parsePostForm(r.r) // same as http.Request.PostFormValue, errors are ignored
+	}
+	values := r.r.PostForm[name]
+	if values == nil {
+		return []string{}
+	}
+	return values
 }
 
 func (r *requestImpl) FormFile(name string) (FormFile, error) {
+	if err := parseMultipartForm(r.r); err != nil {
+		return nil, err
+	}
 	fil, hdr, err := r.r.FormFile(name)
 	if err != nil {
 		return nil, err
@@ -85,272 +354,2666 @@ func (r *requestImpl) FormFile(name string) (FormFile, error) {
 	return &formFileImpl{fil, hdr}, nil
 }
 
-func (r *requestImpl) CookieValue(name, defValue string) string {
-	c, err := r.r.Cookie(name)
+func (r *requestImpl) BindJSON(v any) error {
+	ctype := r.r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return fmt.Errorf("cannot bind json: wrong content type %q", ctype)
+	}
+	data, err := io.ReadAll(io.LimitReader(r.r.Body, MaxJsonBodySize+1))
 	if err != nil {
-		return defValue
+		return fmt.Errorf("cannot bind json: %w", err)
 	}
-	return c.Value
+	if int64(len(data)) > MaxJsonBodySize {
+		return fmt.Errorf("cannot bind json: %w", ErrBodyTooLarge)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("cannot bind json: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("cannot bind json: unexpected data after json value")
+	}
+	return nil
 }
 
-// A formFileImpl is a FormFile that wraps a multipart.File
-type formFileImpl struct {
-	mf multipart.File
-	mh *multipart.FileHeader
+func (r *requestImpl) IsSecure() bool {
+	if r.r.TLS != nil {
+		return true
+	}
+	if !isTrustedProxy(r.r.RemoteAddr) {
+		return false
+	}
+	return strings.EqualFold(lastHeaderValue(r.r.Header, "X-Forwarded-Proto"), "https")
 }
 
-func (f *formFileImpl) Filename() string {
-	return f.mh.Filename
+func (r *requestImpl) Scheme() string {
+	if r.IsSecure() {
+		return "https"
+	}
+	return "http"
 }
 
-func (f *formFileImpl) Size() int64 {
-	return f.mh.Size
+func (r *requestImpl) Host() string {
+	if isTrustedProxy(r.r.RemoteAddr) {
+		if host := lastHeaderValue(r.r.Header, "X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return r.r.Host
 }
 
-func (f *formFileImpl) ReadAll() ([]byte, error) {
-	return io.ReadAll(f.mf)
+// lastHeaderValue returns the rightmost entry of a comma-separated header,
+// which may be sent in several lines. Like in RemoteIP, entries left of it
+// were sent by the client or a previous proxy and may be spoofed.
+func lastHeaderValue(header http.Header, key string) string {
+	values := header.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
 }
 
-func (f *formFileImpl) Read(p []byte) (int, error) {
-	return f.mf.Read(p)
+func (r *requestImpl) RemoteIP() string {
+	peer := remoteHost(r.r.RemoteAddr)
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	// each proxy appends the address it received the request from, so
+	// entries left of the rightmost untrusted one may be spoofed
+	var forwarded []string
+	for _, value := range r.r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	if len(forwarded) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.r.Header.Get("X-Real-Ip"))); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+	clientIP := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		clientIP = ip.String()
+		if !isTrustedIP(ip) {
+			break
+		}
+	}
+	return clientIP
 }
 
-func (f *formFileImpl) Close() error {
-	return f.mf.Close()
+func (r *requestImpl) StartTime() time.Time {
+	t, _ := r.r.Context().Value(startTimeKey).(time.Time)
+	return t
 }
 
-// Response holds response data.
-type Response struct {
-	Type               ResponseType
-	TemplateName       string            // for Type TemplateResponse
-	TemplateData       M                 // for Type TemplateResponse
-	JsonData           any               // for Type JsonResponse
-	FileName           string            // for Type FileResponse
-	FileType           string            // for Type FileResponse
-	FileDisposition    string            // for Type FileResponse
-	ContentData        []byte            // for Type ContentResponse
-	ContentType        string            // for Type ContentResponse
-	ContentDisposition string            // for Type ContentResponse
-	RedirectLocation   string            // for Type RedirectResponse
-	StatusCode         int               // for Type StatusResponse
-	StatusText         string            // for Type StatusResponse
-	Cookies            []*http.Cookie    // for all response types
-	Headers            map[string]string // for all response types
+func (r *requestImpl) CspNonce() string {
+	nonce, _ := r.r.Context().Value(cspNonceKey).(string)
+	return nonce
 }
 
-type ResponseType int
-
-const (
-	TemplateResponse ResponseType = iota + 1
-	JsonResponse
-	FileResponse
-	ContentResponse
-	RedirectResponse
-	StatusResponse
-)
-
-// NewTemplateResponse renders a template.
-func NewTemplateResponse(name string, data M) Response {
-	return Response{Type: TemplateResponse, TemplateName: name, TemplateData: data}
+func (r *requestImpl) PreferredLanguage(supported []string) string {
+	return preferredLanguage(r.r.Header.Get("Accept-Language"), supported)
 }
 
-// NewJsonResponse writes JSON data.
-func NewJsonResponse(data any) Response {
-	return Response{Type: JsonResponse, JsonData: data}
+// preferredLanguage implements Request.PreferredLanguage.
+func preferredLanguage(acceptLanguage string, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+	var ranges []languageRange
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		if params != "" {
+			name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if strings.TrimSpace(name) != "q" || err != nil || q < 0 || q > 1 {
+				continue // ignore malformed ranges
+			}
+			quality = q
+		}
+		ranges = append(ranges, languageRange{tag, quality})
+	}
+	best, bestQuality, bestSpecificity := supported[0], 0.0, 0
+	for _, language := range supported {
+		tag := strings.ToLower(language)
+		quality, specificity := 0.0, 0
+		for _, rng := range ranges {
+			spec := 0
+			switch {
+			case rng.tag == tag:
+				spec = 4
+			case strings.HasPrefix(tag, rng.tag+"-"):
+				spec = 3
+			case strings.HasPrefix(rng.tag, tag+"-"):
+				spec = 2
+			case rng.tag == "*":
+				spec = 1
+			}
+			if spec > specificity {
+				quality, specificity = rng.quality, spec
+			}
+		}
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && specificity > bestSpecificity) {
+			best, bestQuality, bestSpecificity = language, quality, specificity
+		}
+	}
+	return best
 }
 
-// NewFileResponse writes a file.
-func NewFileResponse(name string, ctype, disposition string) Response {
-	return Response{Type: FileResponse, FileName: name, FileType: ctype, FileDisposition: disposition}
+func (r *requestImpl) BasicAuth() (string, string, bool) {
+	return r.r.BasicAuth()
 }
 
-// NewContentResponse writes arbitrary data.
-func NewContentResponse(data []byte, ctype string, disposition string) Response {
-	return Response{Type: ContentResponse, ContentData: data, ContentType: ctype, ContentDisposition: disposition}
+func (r *requestImpl) BearerToken() string {
+	return bearerToken(r.r.Header.Get("Authorization"))
 }
 
-// NewRedirectResponse writes a redirect response.
-func NewRedirectResponse(location string) Response {
-	return Response{Type: RedirectResponse, RedirectLocation: location}
+// bearerToken returns the token of a bearer Authorization header value.
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	token = strings.TrimSpace(token)
+	if strings.ContainsAny(token, " \t") {
+		return ""
+	}
+	return token
 }
 
-// NewStatusResponse writes a status response.
-func NewStatusResponse(code int, text string) Response {
-	return Response{Type: StatusResponse, StatusCode: code, StatusText: text}
+func (r *requestImpl) IsHtmx() bool {
+	return isHtmx(r.r)
 }
 
-// NewStatusNotFoundResponse writes a status 404 response.
-func NewStatusNotFoundResponse(format string, a ...any) Response {
-	return NewStatusResponse(404, fmt.Sprintf(format, a...))
+func (r *requestImpl) Context() context.Context {
+	return r.r.Context()
 }
 
-// NewStatusInternalServerErrorResponse writes a status 500 response.
-func NewStatusInternalServerErrorResponse(format string, a ...any) Response {
-	return NewStatusResponse(500, fmt.Sprintf(format, a...))
+// isHtmx returns true if r was made by htmx.
+func isHtmx(r *http.Request) bool {
+	return r.Header.Get("Hx-Request") == "true"
 }
 
-// WithCookie adds a cookie to the HTTP response.
-//   - maxAge = 0 means no 'Max-Age' attribute specified.
-//   - maxAge < 0 means delete cookie now, equivalently 'Max-Age: 0'
-//   - maxAge > 0 means Max-Age attribute present
-func (r Response) WithCookie(name, value string, maxAge time.Duration) Response {
-	maxAgeSec := int(maxAge / time.Second)
-	if maxAge < 0 {
-		maxAgeSec = -1
-	}
-	r.Cookies = append(r.Cookies, &http.Cookie{
-		Name:   name,
-		Value:  value,
-		MaxAge: maxAgeSec,
-	})
-	return r
+func (r *requestImpl) Param(name string) string {
+	params, _ := r.r.Context().Value(paramsKey).(map[string]string)
+	return params[name]
 }
 
-// WithDeleteCookie is the same as WithCookie(name, "", -1).
-func (r Response) WithDeleteCookie(name string) Response {
-	return r.WithCookie(name, "", -1)
+func (r *requestImpl) Cookies() []*http.Cookie {
+	return r.r.Cookies()
 }
 
-// WithHeader adds a header to the response.
-func (r Response) WithHeader(key, value string) Response {
-	if r.Headers == nil {
-		r.Headers = make(map[string]string)
+func (r *requestImpl) CookieValue(name, defValue string) string {
+	c, err := r.r.Cookie(name)
+	if err != nil {
+		return defValue
 	}
-	r.Headers[key] = value
-	return r
+	return c.Value
 }
 
-// A TemplateLoader loads templates.
-type TemplateLoader interface {
-	Load() (*template.Template, error)
+func (r *requestImpl) Header(name string) string {
+	values := r.HeaderValues(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
 }
 
-// A DefaultTemplateLoader is a TemplateLoader that loads templates from files.
-// It uses template.ParseGlob() internally.
-type DefaultTemplateLoader struct {
-	templatesPattern string
-	funcs            template.FuncMap
-	cachedTemplate   *template.Template
+func (r *requestImpl) HeaderValues(name string) []string {
+	return r.r.Header[textproto.CanonicalMIMEHeaderKey(name)]
 }
 
-var _ TemplateLoader = (*DefaultTemplateLoader)(nil)
-
-func NewDefaultTemplateLoader(templatesPattern string, funcs template.FuncMap, reload bool) (TemplateLoader, error) {
-	loader := &DefaultTemplateLoader{templatesPattern, funcs, nil}
-	if !reload {
-		templ, err := loader.parse()
-		if err != nil {
-			return nil, err
-		}
-		loader.cachedTemplate = templ
-	}
-	return loader, nil
+func (r *requestImpl) HasHeader(name string) bool {
+	_, ok := r.r.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok
 }
 
-func (l *DefaultTemplateLoader) Load() (*template.Template, error) {
-	if l.cachedTemplate != nil {
-		return l.cachedTemplate, nil
+// parseInt parses s as int, or returns defValue if s is not a valid int.
+func parseInt(s string, defValue int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return defValue
 	}
-	return l.parse()
+	return n
 }
 
-func (l *DefaultTemplateLoader) parse() (*template.Template, error) {
-	tpl := template.New("")
-	tpl.Funcs(l.funcs)
-	_, err := tpl.ParseGlob(l.templatesPattern)
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse templates: %w", err)
+// parseBool parses s as bool, or returns defValue if s is not a valid bool.
+func parseBool(s string, defValue bool) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "on", "yes":
+		return true
+	case "0", "false", "off", "no":
+		return false
 	}
-	return tpl, nil
+	return defValue
 }
 
-// A NullTemplateLoader is a TemplateLoader that does nothing.
-// Useful for pure REST apps that do not render HTML templates.
-type NullTemplateLoader struct {
-	err error
+func (r *requestImpl) BindQuery(v any) error {
+	return bindValues("query", r.r.URL.Query(), nil, v)
 }
 
-var _ TemplateLoader = (*NullTemplateLoader)(nil)
-
-func NewNullTemplateLoader() TemplateLoader {
-	return &NullTemplateLoader{
-		errors.New("NullTemplateLoader cannot Load() anything"),
+func (r *requestImpl) BindForm(v any) error {
+	mediaType, _, _ := mime.ParseMediaType(r.r.Header.Get("Content-Type"))
+	var files map[string][]*multipart.FileHeader
+	if mediaType == "multipart/form-data" {
+		if err := parseMultipartForm(r.r); err != nil {
+			return fmt.Errorf("cannot bind form: %w", err)
+		}
+		files = r.r.MultipartForm.File
+	} else if err := r.r.ParseForm(); err != nil {
+		return fmt.Errorf("cannot bind form: %w", err)
+	}
+	if err := bindValues("form", r.r.PostForm, files, v); err != nil {
+		return err
+	}
+	if validator, ok := v.(interface{ Validate() error }); ok {
+		return validator.Validate()
 	}
+	return nil
 }
 
-func (l *NullTemplateLoader) Load() (*template.Template, error) {
-	return nil, l.err
-}
+// formFileType is the reflect.Type of FormFile.
+var formFileType = reflect.TypeOf((*FormFile)(nil)).Elem()
 
-// A ResponseRenderer renders responses.
-type ResponseRenderer struct {
-	templateLoader TemplateLoader
+// bindValues implements Request.BindQuery and Request.BindForm: it sets
+// the fields of the struct that v points to from values and files,
+// by the names in the struct tags with key tag.
+func bindValues(tag string, values url.Values, files map[string][]*multipart.FileHeader, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot bind %s: %T is not a pointer to a struct", tag, v)
+	}
+	rv = rv.Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name := field.Tag.Get(tag)
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		var err error
+		if field.Type == formFileType || field.Type == reflect.SliceOf(formFileType) {
+			err = setFileField(rv.Field(i), files[name])
+		} else {
+			var nonEmpty []string
+			for _, value := range values[name] {
+				if value != "" {
+					nonEmpty = append(nonEmpty, value)
+				}
+			}
+			if len(nonEmpty) == 0 {
+				continue
+			}
+			err = setField(rv.Field(i), nonEmpty)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot bind %s: field %s: %w", tag, field.Name, err)
+		}
+	}
+	return nil
 }
 
-func NewResponseRenderer(templateLoader TemplateLoader) *ResponseRenderer {
-	if templateLoader == nil {
-		panic("no templateLoader")
+// setFileField sets f, a FormFile or []FormFile, to the opened files of headers.
+func setFileField(f reflect.Value, headers []*multipart.FileHeader) error {
+	if len(headers) == 0 {
+		return nil
 	}
-	return &ResponseRenderer{templateLoader}
+	var formFiles []FormFile
+	for _, hdr := range headers {
+		mf, err := hdr.Open()
+		if err != nil {
+			for _, ff := range formFiles {
+				ff.Close()
+			}
+			return err
+		}
+		formFiles = append(formFiles, &formFileImpl{mf, hdr})
+	}
+	if f.Kind() == reflect.Slice {
+		f.Set(reflect.ValueOf(formFiles))
+	} else {
+		f.Set(reflect.ValueOf(&formFiles[0]).Elem())
+		for _, ff := range formFiles[1:] {
+			ff.Close()
+		}
+	}
+	return nil
 }
 
-// Render renders a response
-func (r *ResponseRenderer) Render(w http.ResponseWriter, req *http.Request, response Response) {
-	// cookies and headers
-	for _, c := range response.Cookies {
-		http.SetCookie(w, c)
+// setField sets f to the first value, or to all values if f is a slice.
+func setField(f reflect.Value, values []string) error {
+	if f.Kind() != reflect.Slice {
+		return setFieldValue(f, values[0])
 	}
-	for key, value := range response.Headers {
-		w.Header().Add(key, value)
+	slice := reflect.MakeSlice(f.Type(), len(values), len(values))
+	for i, value := range values {
+		if err := setFieldValue(slice.Index(i), value); err != nil {
+			return err
+		}
 	}
-	// content
-	switch response.Type {
-	case TemplateResponse:
-		tpl, err := r.templateLoader.Load()
+	f.Set(slice)
+	return nil
+}
+
+// setFieldValue parses s according to the type of f and sets f.
+func setFieldValue(f reflect.Value, s string) error {
+	if f.Type() == reflect.TypeOf(time.Time{}) {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				f.Set(reflect.ValueOf(t))
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid time %q", s)
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "1", "true", "on", "yes":
+			f.SetBool(true)
+		case "0", "false", "off", "no":
+			f.SetBool(false)
+		default:
+			return fmt.Errorf("invalid bool %q", s)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
 		if err != nil {
-			errMsg := fmt.Sprintf("cannot load templates: %s", err)
-			http.Error(w, errMsg, http.StatusInternalServerError)
-			return
+			return fmt.Errorf("invalid int %q", s)
 		}
-		w.WriteHeader(200)
-		err = tpl.ExecuteTemplate(w, response.TemplateName, response.TemplateData)
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
 		if err != nil {
-			errMsg := fmt.Sprintf("cannot render %s: %s", response.TemplateName, err)
-			io.WriteString(w, errMsg)
+			return fmt.Errorf("invalid uint %q", s)
 		}
-	case JsonResponse:
-		data, err := json.Marshal(response.JsonData)
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, f.Type().Bits())
 		if err != nil {
-			errMsg := fmt.Sprintf("cannot marshal json: %s", err)
-			http.Error(w, errMsg, http.StatusInternalServerError)
-			return
+			return fmt.Errorf("invalid float %q", s)
+		}
+		f.SetFloat(x)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// parsePostForm parses a urlencoded or multipart request body. Multipart
+// bodies are limited by MaxUploadSize, see parseMultipartForm.
+func parsePostForm(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		return parseMultipartForm(r)
+	}
+	return r.ParseForm()
+}
+
+// parseMultipartForm parses a multipart request body, if not parsed before.
+// It returns ErrBodyTooLarge if the body is larger than MaxUploadSize.
+func parseMultipartForm(r *http.Request) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	// check size before parts are buffered in memory or on disk
+	if r.ContentLength > MaxUploadSize {
+		return fmt.Errorf("cannot read form file: %w", ErrBodyTooLarge)
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, MaxUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return fmt.Errorf("cannot read form file: %w", ErrBodyTooLarge)
+		}
+		return err
+	}
+	return nil
+}
+
+// A TestRequest is a Request for unit tests of handlers, e.g.
+//
+//	req := NewTestRequest("POST", "/add").WithPostForm("value1", "13")
+//	res := server.servAdd(req)
+//
+// It wraps a *http.Request, so it behaves like a real request.
+type TestRequest struct {
+	Request
+	r        *http.Request
+	postForm url.Values
+}
+
+// NewTestRequest creates a TestRequest for method and target, a path
+// with an optional query, e.g. "/search?q=go". The host is example.com,
+// the remote address is 192.0.2.1:1234, like with httptest.NewRequest.
+func NewTestRequest(method, target string) *TestRequest {
+	return (&TestRequest{}).with(newRequest(method, target))
+}
+
+// with sets the wrapped request.
+func (t *TestRequest) with(r *http.Request) *TestRequest {
+	t.r = r
+	t.Request = NewRequest(r)
+	return t
+}
+
+// WithMethod sets the request method.
+func (t *TestRequest) WithMethod(method string) *TestRequest {
+	t.r.Method = method
+	return t
+}
+
+// WithQuery adds a query parameter.
+func (t *TestRequest) WithQuery(name, value string) *TestRequest {
+	query := t.r.URL.Query()
+	query.Add(name, value)
+	t.r.URL.RawQuery = query.Encode()
+	return t
+}
+
+// WithPostForm adds a form field to an urlencoded request body.
+// The form is read for POST, PUT and PATCH requests only.
+func (t *TestRequest) WithPostForm(name string, values ...string) *TestRequest {
+	if t.postForm == nil {
+		t.postForm = url.Values{}
+	}
+	t.postForm[name] = append(t.postForm[name], values...)
+	return t.WithBody("application/x-www-form-urlencoded", t.postForm.Encode())
+}
+
+// WithBody sets the request body, e.g. for Request.BindJSON.
+func (t *TestRequest) WithBody(ctype, body string) *TestRequest {
+	t.r.Header.Set("Content-Type", ctype)
+	t.r.Body = io.NopCloser(strings.NewReader(body))
+	t.r.ContentLength = int64(len(body))
+	return t
+}
+
+// WithHeader sets a request header.
+func (t *TestRequest) WithHeader(name, value string) *TestRequest {
+	t.r.Header.Set(name, value)
+	return t
+}
+
+// WithCookie adds a cookie.
+func (t *TestRequest) WithCookie(name, value string) *TestRequest {
+	t.r.AddCookie(&http.Cookie{Name: name, Value: value})
+	return t
+}
+
+// WithParam sets a path parameter, see Request.Param.
+func (t *TestRequest) WithParam(name, value string) *TestRequest {
+	params := map[string]string{name: value}
+	if old, ok := t.r.Context().Value(paramsKey).(map[string]string); ok {
+		for k, v := range old {
+			if k != name {
+				params[k] = v
+			}
+		}
+	}
+	return t.with(t.r.WithContext(context.WithValue(t.r.Context(), paramsKey, params)))
+}
+
+// WithRemoteAddr sets the network address of the client, e.g. "203.0.113.7:4711".
+func (t *TestRequest) WithRemoteAddr(addr string) *TestRequest {
+	t.r.RemoteAddr = addr
+	return t
+}
+
+// WithContext sets the request context, e.g. a canceled one.
+// Path parameters are kept.
+func (t *TestRequest) WithContext(ctx context.Context) *TestRequest {
+	if params, ok := t.r.Context().Value(paramsKey).(map[string]string); ok {
+		ctx = context.WithValue(ctx, paramsKey, params)
+	}
+	return t.with(t.r.WithContext(ctx))
+}
+
+// HttpRequest returns the wrapped *http.Request, e.g. for ResponseRenderer.Render.
+func (t *TestRequest) HttpRequest() *http.Request {
+	return t.r
+}
+
+// A RecordedResponse is a rendered Response, see ResponseRenderer.Record.
+// Its Assert methods return an error that describes a failed assertion, e.g.
+//
+//	rec := renderer.Record(req.HttpRequest(), server.servLogin(req))
+//	if err := rec.AssertRedirect("/home"); err != nil {
+//		t.Fatal(err)
+//	}
+type RecordedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+	Cookies    []*http.Cookie
+}
+
+// Record renders response for req, e.g. TestRequest.HttpRequest, and returns
+// the recorded output, for handler tests. If req is nil, a GET request for "/" is used.
+func (r *ResponseRenderer) Record(req *http.Request, response Response) *RecordedResponse {
+	if req == nil {
+		req = newRequest("GET", "/")
+	}
+	rec := newResponseRecorder()
+	r.Render(rec, req, response)
+	return &RecordedResponse{rec.statusCode(), rec.header, rec.body.String(), rec.cookies()}
+}
+
+// Cookie returns the last cookie set with name, or nil if not found.
+func (r *RecordedResponse) Cookie(name string) *http.Cookie {
+	var cookie *http.Cookie
+	for _, c := range r.Cookies {
+		if c.Name == name {
+			cookie = c
+		}
+	}
+	return cookie
+}
+
+// AssertStatus checks the status code.
+func (r *RecordedResponse) AssertStatus(code int) error {
+	if r.StatusCode != code {
+		return fmt.Errorf("expected status %d but was %d", code, r.StatusCode)
+	}
+	return nil
+}
+
+// AssertRedirect checks that the response redirects to location.
+func (r *RecordedResponse) AssertRedirect(location string) error {
+	if r.StatusCode < 300 || r.StatusCode > 399 {
+		return fmt.Errorf("expected redirect to %q but status was %d", location, r.StatusCode)
+	}
+	if actual := r.Header.Get("Location"); actual != location {
+		return fmt.Errorf("expected redirect to %q but was to %q", location, actual)
+	}
+	return nil
+}
+
+// AssertJson checks that the response has JSON content and unmarshals it into v.
+func (r *RecordedResponse) AssertJson(v any) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return fmt.Errorf("expected json but content type was %q", r.Header.Get("Content-Type"))
+	}
+	if err := json.Unmarshal([]byte(r.Body), v); err != nil {
+		return fmt.Errorf("cannot unmarshal json: %w", err)
+	}
+	return nil
+}
+
+// AssertBodyContains checks that the body contains s.
+func (r *RecordedResponse) AssertBodyContains(s string) error {
+	if !strings.Contains(r.Body, s) {
+		return fmt.Errorf("expected body to contain %q but was %q", s, r.Body)
+	}
+	return nil
+}
+
+// A formFileImpl is a FormFile that wraps a multipart.File
+type formFileImpl struct {
+	mf multipart.File
+	mh *multipart.FileHeader
+}
+
+func (f *formFileImpl) Filename() string {
+	return f.mh.Filename
+}
+
+func (f *formFileImpl) Size() int64 {
+	return f.mh.Size
+}
+
+func (f *formFileImpl) ReadAll() ([]byte, error) {
+	return io.ReadAll(f.mf)
+}
+
+func (f *formFileImpl) Read(p []byte) (int, error) {
+	return f.mf.Read(p)
+}
+
+func (f *formFileImpl) Close() error {
+	return f.mf.Close()
+}
+
+// Response holds response data.
+// The zero Response, see IsZero, is rendered as 404 Not Found, so handlers
+// can return Response{} for paths they do not serve.
+type Response struct {
+	Type               ResponseType
+	TemplateName       string              // for Type TemplateResponse and NegotiatedResponse
+	TemplateData       M                   // for Type TemplateResponse and NegotiatedResponse
+	LayoutName         string              // for Type TemplateResponse, optional
+	TemplateFuncs      template.FuncMap    // for Type TemplateResponse, optional
+	JsonData           any                 // for Type JsonResponse and JsonpResponse
+	JsonpCallback      string              // for Type JsonpResponse
+	JsonIndent         string              // for Type JsonResponse, optional
+	XmlData            any                 // for Type XmlResponse
+	FileName           string              // for Type FileResponse
+	FileFS             fs.FS               // for Type FileResponse, optional, if nil FileName is an OS path
+	FileType           string              // for Type FileResponse
+	FileDisposition    string              // for Type FileResponse
+	ContentData        []byte              // for Type ContentResponse
+	ContentType        string              // for Type ContentResponse, StreamResponse and SeekableResponse
+	ContentDisposition string              // for Type ContentResponse, StreamResponse, SeekableResponse and CsvResponse
+	StreamReader       io.Reader           // for Type StreamResponse
+	SeekableContent    io.ReadSeeker       // for Type SeekableResponse
+	SeekableName       string              // for Type SeekableResponse, optional
+	SeekableModTime    time.Time           // for Type SeekableResponse, optional
+	CsvHeader          []string            // for Type CsvResponse, optional
+	CsvRows            CsvRowsFunc         // for Type CsvResponse
+	RedirectLocation   string              // for Type RedirectResponse
+	StatusCode         int                 // for Type StatusResponse, TemplateResponse, JsonResponse, XmlResponse, ContentResponse, StreamResponse and RedirectResponse
+	StatusText         string              // for Type StatusResponse
+	JsonLines          <-chan any          // for Type JsonLinesResponse
+	Cookies            []*http.Cookie      // for all response types
+	Headers            map[string]string   // for all response types, unless set by a http.Handler before the renderer
+	HeaderValues       map[string][]string // for all response types, for headers with multiple values
+}
+
+type ResponseType int
+
+const (
+	TemplateResponse ResponseType = iota + 1
+	JsonResponse
+	FileResponse
+	ContentResponse
+	RedirectResponse
+	StatusResponse
+	JsonLinesResponse
+	XmlResponse
+	StreamResponse
+	NegotiatedResponse
+	CsvResponse
+	SeekableResponse
+	JsonpResponse
+)
+
+// IsZero returns true if r is the zero Response, i.e. it has no type.
+// ResponseRenderer.Render writes 404 Not Found for it, using the
+// NotFoundHandler if set.
+func (r Response) IsZero() bool {
+	return r.Type == 0
+}
+
+// NewTemplateResponse renders a template.
+func NewTemplateResponse(name string, data M) Response {
+	return Response{Type: TemplateResponse, TemplateName: name, TemplateData: data}
+}
+
+// NewNegotiatedResponse renders a template for browsers, or writes data as JSON
+// for API clients, depending on the request's Accept header.
+// Data is written as JSON if the quality of application/json is higher than
+// the quality of text/html. The quality of a media type is the q value of
+// the most specific matching media range in Accept, e.g. "application/json"
+// before "application/*" before "*/*", or 0 if no range matches.
+// Therefore, a missing Accept header, or a tie, renders the template.
+func NewNegotiatedResponse(templateName string, data M) Response {
+	return Response{Type: NegotiatedResponse, TemplateName: templateName, TemplateData: data}
+}
+
+// NewLayoutResponse renders a content template inside a layout template.
+// The layout includes the content with {{template "content" .}}.
+// All templates share one namespace: {{define}} blocks in one file are visible to
+// all others, and a block defined twice is overwritten by the file parsed last.
+// Therefore the layout should only rely on "content", or on {{define}}
+// blocks with names unique to each page.
+// The name "content" is reserved and must not be used for other templates.
+func NewLayoutResponse(layout, content string, data M) Response {
+	return Response{Type: TemplateResponse, LayoutName: layout, TemplateName: content, TemplateData: data}
+}
+
+// WithTemplateFuncs adds template funcs for rendering this response only,
+// e.g. a csrfField func that depends on the current session.
+// Since templates are parsed before, each func must also be declared in the
+// TemplateLoader's FuncMap, e.g. with a placeholder implementation.
+// Templates are copied for responses with funcs, responses without funcs
+// use the cached templates.
+func (r Response) WithTemplateFuncs(funcs template.FuncMap) Response {
+	newFuncs := make(template.FuncMap, len(r.TemplateFuncs)+len(funcs))
+	for k, v := range r.TemplateFuncs {
+		newFuncs[k] = v
+	}
+	for k, v := range funcs {
+		newFuncs[k] = v
+	}
+	r.TemplateFuncs = newFuncs
+	return r
+}
+
+// NewJsonResponse writes JSON data.
+func NewJsonResponse(data any) Response {
+	return Response{Type: JsonResponse, JsonData: data}
+}
+
+// NewIndentedJsonResponse writes pretty-printed JSON data, each level
+// indented with indent, e.g. for debugging.
+func NewIndentedJsonResponse(data any, indent string) Response {
+	return Response{Type: JsonResponse, JsonData: data, JsonIndent: indent}
+}
+
+// NewJsonpResponse writes JSON data wrapped in a call of callback, for
+// legacy clients that cannot use CORS. The callback name is validated when
+// the response is rendered: it must be a JavaScript identifier, or a dotted
+// path of identifiers like "widget.onData", otherwise status 400 is written.
+// Since JSONP executes in the client's page, use it for public data only.
+func NewJsonpResponse(callback string, data any) Response {
+	return Response{Type: JsonpResponse, JsonpCallback: callback, JsonData: data}
+}
+
+// isJsonpCallback returns true if name is a safe JSONP callback name, i.e.
+// dot-separated identifiers consisting of ASCII letters, digits, '_' and '$'.
+func isJsonpCallback(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for _, ident := range strings.Split(name, ".") {
+		if ident == "" {
+			return false
+		}
+		for i, c := range ident {
+			ok := c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (i > 0 && '0' <= c && c <= '9')
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NewJsonResultResponse writes data as JSON, or err as a JSON error object
+// {"error":"message","code":404} if err is not nil.
+// If err is an *ApiError, its status code and message are written. All other
+// errors are logged and written as status 500 with a generic message, so that
+// internal details are not leaked to clients.
+func NewJsonResultResponse(data any, err error) Response {
+	if err == nil {
+		return NewJsonResponse(data)
+	}
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		log.Printf("webs: internal server error: %s", err)
+		apiErr = NewApiError(http.StatusInternalServerError, "internal server error")
+	}
+	return NewJsonErrorResponse(apiErr.StatusCode, apiErr.Message)
+}
+
+// NewJsonErrorResponse writes a JSON error object {"error":"message","code":404}
+// with a status code, which is repeated in the object.
+// All errors of NewJsonResultResponse have the same format, so clients can
+// parse every error the same way.
+func NewJsonErrorResponse(code int, message string) Response {
+	return NewJsonResponse(jsonError{message, code}).WithStatus(code)
+}
+
+// jsonError is the JSON body of an error response.
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// ApiError is an error with a HTTP status code, see NewJsonResultResponse.
+type ApiError struct {
+	StatusCode int
+	Message    string
+}
+
+// NewApiError creates an *ApiError.
+func NewApiError(code int, format string, a ...any) *ApiError {
+	return &ApiError{code, fmt.Sprintf(format, a...)}
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+// JsonHandler adapts a handler that returns data and error to a handler
+// that returns a Response, see NewJsonResultResponse.
+func JsonHandler(f func(Request) (any, error)) func(Request) Response {
+	return func(req Request) Response {
+		return NewJsonResultResponse(f(req))
+	}
+}
+
+// NewXmlResponse writes XML data, marshaled with encoding/xml.
+func NewXmlResponse(data any) Response {
+	return Response{Type: XmlResponse, XmlData: data}
+}
+
+// NewJsonLinesResponse writes newline-delimited JSON (ndjson), one line per
+// record received from records. The caller must close records after the last record.
+// Records that cannot be marshaled are logged and skipped.
+func NewJsonLinesResponse(records <-chan any) Response {
+	return Response{Type: JsonLinesResponse, JsonLines: records}
+}
+
+// NewFileResponse writes a file.
+// It sets a weak ETag header computed from the file's size and modification time.
+func NewFileResponse(name string, ctype, disposition string) Response {
+	return Response{Type: FileResponse, FileName: name, FileType: ctype, FileDisposition: disposition}
+}
+
+// NewFileResponseFS writes a file from fsys, e.g. an embed.FS.
+// Like NewFileResponse, it supports range requests and conditional requests.
+// For files without a modification time, like embedded files, the
+// ETag header is computed from the file's content.
+func NewFileResponseFS(fsys fs.FS, name string, ctype, disposition string) Response {
+	return Response{Type: FileResponse, FileFS: fsys, FileName: name, FileType: ctype, FileDisposition: disposition}
+}
+
+// NewContentResponse writes arbitrary data.
+// It supports range requests and conditional requests: the ETag header is
+// computed from data, and a matching If-None-Match yields 304 Not Modified.
+// If ctype is empty, the content type is application/octet-stream and
+// browsers must not sniff it.
+func NewContentResponse(data []byte, ctype string, disposition string) Response {
+	return Response{Type: ContentResponse, ContentData: data, ContentType: ctype, ContentDisposition: disposition}
+}
+
+// NewStreamResponse copies data from reader, without holding all data in memory.
+// If ctype is empty, the content type is application/octet-stream, see NewContentResponse.
+// If reader is an io.Closer, it is closed after copying.
+func NewStreamResponse(reader io.Reader, ctype string) Response {
+	return Response{Type: StreamResponse, StreamReader: reader, ContentType: ctype}
+}
+
+// NewSeekableResponse writes content through http.ServeContent, e.g. a
+// generated audio clip that media players seek in. Use bytes.NewReader
+// for in-memory data. It supports range requests and conditional requests
+// with If-Modified-Since, if modtime is not zero.
+// If ctype is empty, the content type is derived from the extension of name.
+// Content is never sniffed: without ctype and a known extension, it is sent
+// as application/octet-stream with X-Content-Type-Options: nosniff.
+// Both name and modtime are optional.
+// If content is an io.Closer, it is closed after writing.
+func NewSeekableResponse(content io.ReadSeeker, name string, modtime time.Time, ctype string) Response {
+	return Response{Type: SeekableResponse, SeekableContent: content, SeekableName: name, SeekableModTime: modtime, ContentType: ctype}
+}
+
+// CsvRowsFunc produces the rows of a CsvResponse by calling write for each row.
+// It must stop and return the error if write returns an error.
+type CsvRowsFunc func(write func(row []string) error) error
+
+// NewCsvResponse streams CSV rows that browsers download as filename,
+// without holding all rows in memory. The header row is optional.
+// Since the status code is sent before the rows, errors returned by rows
+// are logged and the download is truncated.
+func NewCsvResponse(filename string, header []string, rows CsvRowsFunc) Response {
+	return Response{Type: CsvResponse, CsvHeader: header, CsvRows: rows, ContentDisposition: contentDisposition("attachment", filename)}
+}
+
+// NewHtmlResponse writes pre-rendered HTML, e.g. a HTML fragment.
+func NewHtmlResponse(html string) Response {
+	return NewContentResponse([]byte(html), "text/html; charset=utf-8", "")
+}
+
+// NewStringResponse writes a plain text string, e.g. for health checks.
+func NewStringResponse(str string) Response {
+	return NewContentResponse([]byte(str), "text/plain; charset=utf-8", "")
+}
+
+// NewTextResponse is the same as NewStringResponse.
+func NewTextResponse(text string) Response {
+	return NewStringResponse(text)
+}
+
+// NewPdfResponse writes a PDF document. If inline is true, browsers
+// display it, otherwise they download it as filename.
+func NewPdfResponse(data []byte, filename string, inline bool) Response {
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	return NewContentResponse(data, "application/pdf", contentDisposition(disposition, filename))
+}
+
+// NewDownloadResponse writes data that browsers download as filename.
+// Non-ASCII filenames are supported.
+func NewDownloadResponse(data []byte, filename, ctype string) Response {
+	return NewContentResponse(data, ctype, contentDisposition("attachment", filename))
+}
+
+// contentDisposition formats a Content-Disposition header value with a filename.
+// For non-ASCII filenames, it adds an ASCII fallback filename and
+// a UTF-8 encoded filename* parameter as described in RFC 6266 and RFC 5987.
+func contentDisposition(disposition, filename string) string {
+	ascii := true
+	for i := 0; i < len(filename); i++ {
+		if filename[i] < 0x20 || filename[i] > 0x7e {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	}
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fallback.String()}) + "; filename*=UTF-8''" + encoded.String()
+}
+
+// NewRedirectResponse writes a redirect response with status 303 See Other.
+// For htmx requests, see Request.IsHtmx, it writes status 200 with a
+// HX-Redirect header instead, so that the browser navigates to location.
+func NewRedirectResponse(location string) Response {
+	return Response{Type: RedirectResponse, RedirectLocation: location}
+}
+
+// NewRedirectResponseWithStatus writes a redirect response with status code 301, 302,
+// 303, 307 or 308, e.g. 307 Temporary Redirect to preserve the request method.
+// Other codes are replaced with 303 See Other.
+func NewRedirectResponseWithStatus(location string, code int) Response {
+	return Response{Type: RedirectResponse, RedirectLocation: location, StatusCode: code}
+}
+
+// NewPermanentRedirectResponse writes a redirect response with status 301 Moved Permanently.
+func NewPermanentRedirectResponse(location string) Response {
+	return NewRedirectResponseWithStatus(location, http.StatusMovedPermanently)
+}
+
+// NewStatusResponse writes a status response.
+func NewStatusResponse(code int, text string) Response {
+	return Response{Type: StatusResponse, StatusCode: code, StatusText: text}
+}
+
+// NewBasicAuthChallengeResponse writes a status 401 response that asks
+// browsers for username and password, see Request.BasicAuth.
+func NewBasicAuthChallengeResponse(realm string) Response {
+	challenge := `Basic realm="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(realm) + `", charset="UTF-8"`
+	return NewStatusResponse(http.StatusUnauthorized, "unauthorized").WithHeader("WWW-Authenticate", challenge)
+}
+
+// NewNoContentResponse writes a status 204 response without body,
+// e.g. for a successful DELETE request.
+func NewNoContentResponse() Response {
+	return NewStatusResponse(http.StatusNoContent, "")
+}
+
+// NewCreatedResponse writes a status 201 response with a Location header
+// that points to the created resource, e.g. for a successful POST request.
+func NewCreatedResponse(location string) Response {
+	return NewStatusResponse(http.StatusCreated, "").WithHeader("Location", location)
+}
+
+// NewStatusNotFoundResponse writes a status 404 response.
+func NewStatusNotFoundResponse(format string, a ...any) Response {
+	return NewStatusResponse(404, fmt.Sprintf(format, a...))
+}
+
+// NewStatusInternalServerErrorResponse writes a status 500 response.
+func NewStatusInternalServerErrorResponse(format string, a ...any) Response {
+	return NewStatusResponse(500, fmt.Sprintf(format, a...))
+}
+
+// WithCookie adds a cookie to the HTTP response.
+//   - maxAge = 0 means no 'Max-Age' attribute specified.
+//   - maxAge < 0 means delete cookie now, equivalently 'Max-Age: 0'
+//   - maxAge > 0 means Max-Age attribute present
+func (r Response) WithCookie(name, value string, maxAge time.Duration) Response {
+	return r.WithCookieOpts(name, value, maxAge, CookieOptions{})
+}
+
+// CookieOptions holds optional cookie attributes, see WithCookieOpts.
+type CookieOptions struct {
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+	// Expires, if not zero, sets the Expires attribute to an absolute date.
+	// If a cookie has both Max-Age and Expires, clients use Max-Age,
+	// see RFC 6265 section 5.3; old clients that do not know Max-Age use Expires.
+	Expires time.Time
+}
+
+// WithCookieOpts is like WithCookie but also sets the cookie attributes in opts.
+// Use it to harden cookies, e.g. authentication cookies should be HttpOnly
+// and SameSite=Lax.
+func (r Response) WithCookieOpts(name, value string, maxAge time.Duration, opts CookieOptions) Response {
+	maxAgeSec := int(maxAge / time.Second)
+	if maxAge < 0 {
+		maxAgeSec = -1
+	}
+	r.Cookies = append(r.Cookies[:len(r.Cookies):len(r.Cookies)], &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		MaxAge:   maxAgeSec,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.SameSite,
+		Expires:  opts.Expires,
+	})
+	return r
+}
+
+// WithCookieExpires adds a cookie that expires at an absolute date, with
+// an Expires but no Max-Age attribute. An expiry in the past deletes the cookie.
+func (r Response) WithCookieExpires(name, value string, expires time.Time) Response {
+	return r.WithCookieOpts(name, value, 0, CookieOptions{Expires: expires})
+}
+
+// WithDeleteCookie is the same as WithCookie(name, "", -1).
+func (r Response) WithDeleteCookie(name string) Response {
+	return r.WithCookie(name, "", -1)
+}
+
+// WithHeader adds a header to the response. A header of the same key that
+// a http.Handler before the renderer has set is kept, e.g. the
+// Content-Security-Policy of NewCspNonceHandler.
+// It does not modify the headers of the original response.
+func (r Response) WithHeader(key, value string) Response {
+	newHeaders := make(map[string]string, len(r.Headers)+1)
+	for k, v := range r.Headers {
+		newHeaders[k] = v
+	}
+	newHeaders[key] = value
+	r.Headers = newHeaders
+	return r
+}
+
+// WithHeaderValues adds a header with one or more values to the response,
+// e.g. several Link headers. Values are added to previous values for the same key.
+// It does not modify the headers of the original response.
+func (r Response) WithHeaderValues(key string, values ...string) Response {
+	newHeaderValues := make(map[string][]string, len(r.HeaderValues)+1)
+	for k, v := range r.HeaderValues {
+		newHeaderValues[k] = v
+	}
+	old := newHeaderValues[key]
+	newHeaderValues[key] = append(old[:len(old):len(old)], values...)
+	r.HeaderValues = newHeaderValues
+	return r
+}
+
+// WithCacheControl allows clients and proxies to cache the response for maxAge.
+// It sets the Cache-Control header, and removes the Expires and Pragma headers
+// of WithNoCache. No Expires header is set, since max-age takes precedence
+// and needs no synchronized clocks.
+func (r Response) WithCacheControl(maxAge time.Duration) Response {
+	seconds := int(maxAge / time.Second)
+	return r.withoutHeaders("Expires", "Pragma").WithHeader("Cache-Control", "max-age="+strconv.Itoa(seconds))
+}
+
+// withoutHeaders removes headers set with WithHeader.
+// It does not modify the headers of the original response.
+func (r Response) withoutHeaders(keys ...string) Response {
+	newHeaders := make(map[string]string, len(r.Headers))
+	for k, v := range r.Headers {
+		newHeaders[k] = v
+	}
+	for _, key := range keys {
+		delete(newHeaders, key)
+	}
+	r.Headers = newHeaders
+	return r
+}
+
+// WithNoCache forbids clients and proxies to cache the response.
+// It sets the Cache-Control, Expires and Pragma headers, the latter for HTTP/1.0 proxies.
+func (r Response) WithNoCache() Response {
+	return r.WithHeader("Cache-Control", "no-cache, no-store, must-revalidate").WithHeader("Expires", "0").WithHeader("Pragma", "no-cache")
+}
+
+// WithContentType sets the content type of a file, content, stream or seekable response.
+// For other response types, it sets the Content-Type header.
+func (r Response) WithContentType(ctype string) Response {
+	switch r.Type {
+	case FileResponse:
+		r.FileType = ctype
+	case ContentResponse, StreamResponse, SeekableResponse:
+		r.ContentType = ctype
+	default:
+		return r.WithHeader("Content-Type", ctype)
+	}
+	return r
+}
+
+// WithContentDisposition sets the content disposition of a file, content, stream or seekable response.
+// For other response types, it sets the Content-Disposition header.
+func (r Response) WithContentDisposition(disposition string) Response {
+	switch r.Type {
+	case FileResponse:
+		r.FileDisposition = disposition
+	case ContentResponse, StreamResponse, SeekableResponse:
+		r.ContentDisposition = disposition
+	default:
+		return r.WithHeader("Content-Disposition", disposition)
+	}
+	return r
+}
+
+// DefaultContentSecurityPolicy is the Content-Security-Policy of SecurityHeaders.
+// It allows resources from the same origin only, and no framing.
+const DefaultContentSecurityPolicy = "default-src 'self'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'; object-src 'none'"
+
+// SecurityHeaders returns a set of hardening headers: X-Content-Type-Options,
+// X-Frame-Options, Referrer-Policy and Content-Security-Policy with csp, or
+// DefaultContentSecurityPolicy if csp is empty. Use it with
+// Response.WithSecurityHeaders or ResponseRenderer.DefaultHeaders.
+func SecurityHeaders(csp string) map[string]string {
+	if csp == "" {
+		csp = DefaultContentSecurityPolicy
+	}
+	return map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+		"Content-Security-Policy": csp,
+	}
+}
+
+// WithSecurityHeaders adds the headers of SecurityHeaders(csp) to the response.
+// Like for WithHeader, headers set before the renderer are kept, so it can be
+// combined with NewCspNonceHandler.
+func (r Response) WithSecurityHeaders(csp string) Response {
+	for key, value := range SecurityHeaders(csp) {
+		r = r.WithHeader(key, value)
+	}
+	return r
+}
+
+// WithStatus sets the HTTP status code of a template, JSON, XML, content, redirect or status response.
+// A zero code means status 200 for template, JSON, XML and content responses.
+// Content responses with a status code do not support range requests.
+func (r Response) WithStatus(code int) Response {
+	r.StatusCode = code
+	return r
+}
+
+// statusCodeOr returns the response's status code, or defCode if not set.
+func (r Response) statusCodeOr(defCode int) int {
+	if r.StatusCode == 0 {
+		return defCode
+	}
+	return r.StatusCode
+}
+
+// templateNames returns the template name(s) of a TemplateResponse, for error messages.
+func (r Response) templateNames() string {
+	if r.LayoutName == "" {
+		return r.TemplateName
+	}
+	return r.TemplateName + " in layout " + r.LayoutName
+}
+
+// Materialize renders the response now and returns the status code, headers and body,
+// e.g. to store the response and deliver it later.
+// File and streaming responses are not supported and return an error,
+// as do responses that fail to render, e.g. because of a template error,
+// even if the response has status 500.
+// The loader is used for template responses, it may be nil for all other responses.
+func (r Response) Materialize(loader TemplateLoader) (int, http.Header, []byte, error) {
+	switch r.Type {
+	case FileResponse, JsonLinesResponse, StreamResponse:
+		return 0, nil, nil, fmt.Errorf("cannot materialize response type %d", r.Type)
+	}
+	if loader == nil {
+		loader = NewNullTemplateLoader()
+	}
+	rec, err := NewResponseRenderer(loader).renderToRecorder(r)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("cannot materialize response: %w", err)
+	}
+	return rec.statusCode(), rec.header, rec.body.Bytes(), nil
+}
+
+// A TemplateLoader loads templates.
+type TemplateLoader interface {
+	Load() (*template.Template, error)
+}
+
+// RenderTemplate executes the template name with data and returns the output,
+// e.g. to unit-test templates without a HTTP server. Since templates
+// are html/template templates, data is escaped according to its context.
+func RenderTemplate(loader TemplateLoader, name string, data M) (string, error) {
+	tpl, err := loader.Load()
+	if err != nil {
+		return "", fmt.Errorf("cannot load templates: %w", err)
+	}
+	var sb strings.Builder
+	if err := tpl.ExecuteTemplate(&sb, name, data); err != nil {
+		return "", fmt.Errorf("cannot render %s: %w", name, err)
+	}
+	return sb.String(), nil
+}
+
+// defaultTemplateFuncs are available in all templates loaded by webs
+// TemplateLoaders. Custom TemplateLoaders should add them, too.
+//   - cspNonce returns the CSP nonce of the current request, see NewCspNonceHandler.
+var defaultTemplateFuncs = template.FuncMap{
+	"cspNonce": func() string { return "" },
+}
+
+// A TemplateCloner is a TemplateLoader that can return a copy of its templates
+// that can be modified before execution, e.g. for layout responses.
+// Since html/template cannot clone templates that have been executed,
+// TemplateLoaders that cache templates should implement TemplateCloner.
+type TemplateCloner interface {
+	TemplateLoader
+	Clone() (*template.Template, error)
+}
+
+// A DefaultTemplateLoader is a TemplateLoader that loads templates from files
+// that match one or more glob patterns.
+// In reload mode, templates are parsed again when a file has been added,
+// removed or modified since the last parse.
+type DefaultTemplateLoader struct {
+	templatesPatterns []string
+	funcs             template.FuncMap
+	reload            bool
+	mu                sync.Mutex
+	modTimes          map[string]time.Time // of parsed files, for reload mode
+	cachedTemplate    *template.Template
+	masterTemplate    *template.Template // never executed, for Clone()
+}
+
+var _ TemplateCloner = (*DefaultTemplateLoader)(nil)
+
+func NewDefaultTemplateLoader(templatesPattern string, funcs template.FuncMap, reload bool) (TemplateLoader, error) {
+	return NewDefaultTemplateLoaderMulti([]string{templatesPattern}, funcs, reload)
+}
+
+// NewDefaultTemplateLoaderMulti creates a DefaultTemplateLoader that loads templates
+// from several glob patterns, e.g. for pages, partials and emails in different directories.
+// All templates are parsed into the same template set, so file names
+// must be unique across all patterns.
+func NewDefaultTemplateLoaderMulti(templatesPatterns []string, funcs template.FuncMap, reload bool) (TemplateLoader, error) {
+	loader := &DefaultTemplateLoader{templatesPatterns: templatesPatterns, funcs: funcs, reload: reload}
+	if !reload {
+		templ, err := loader.parse()
+		if err != nil {
+			return nil, err
+		}
+		loader.masterTemplate = templ
+		loader.cachedTemplate = template.Must(templ.Clone())
+	}
+	return loader, nil
+}
+
+func (l *DefaultTemplateLoader) Load() (*template.Template, error) {
+	if !l.reload {
+		return l.cachedTemplate, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reparseIfModified(); err != nil {
+		return nil, err
+	}
+	return l.cachedTemplate, nil
+}
+
+func (l *DefaultTemplateLoader) Clone() (*template.Template, error) {
+	if !l.reload {
+		return l.masterTemplate.Clone()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reparseIfModified(); err != nil {
+		return nil, err
+	}
+	return l.masterTemplate.Clone()
+}
+
+// reparseIfModified parses the templates if files have changed since the last parse.
+// The caller must hold l.mu.
+func (l *DefaultTemplateLoader) reparseIfModified() error {
+	modTimes, err := l.statFiles()
+	if err != nil {
+		return err
+	}
+	if l.masterTemplate != nil && equalModTimes(l.modTimes, modTimes) {
+		return nil
+	}
+	templ, err := l.parse()
+	if err != nil {
+		return err
+	}
+	l.masterTemplate = templ
+	l.cachedTemplate = template.Must(templ.Clone())
+	l.modTimes = modTimes
+	return nil
+}
+
+// statFiles returns the modification times of all files that match the templates patterns.
+func (l *DefaultTemplateLoader) statFiles() (map[string]time.Time, error) {
+	filenames, err := l.globFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse templates: %w", err)
+	}
+	modTimes := make(map[string]time.Time, len(filenames))
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat template: %w", err)
+		}
+		modTimes[filename] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func equalModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for filename, t := range a {
+		if bt, ok := b[filename]; !ok || !bt.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// globFiles returns the files that match the templates patterns.
+// It returns an error if a pattern matches no files, or if two files
+// have the same name and would therefore overwrite each other.
+func (l *DefaultTemplateLoader) globFiles() ([]string, error) {
+	var filenames []string
+	seen := make(map[string]string) // template name -> filename
+	for _, pattern := range l.templatesPatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern matches no files: %#q", pattern)
+		}
+		for _, filename := range matches {
+			name := filepath.Base(filename)
+			if other, ok := seen[name]; ok {
+				return nil, fmt.Errorf("duplicate template %q in %s and %s", name, other, filename)
+			}
+			seen[name] = filename
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames, nil
+}
+
+func (l *DefaultTemplateLoader) parse() (*template.Template, error) {
+	filenames, err := l.globFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse templates: %w", err)
+	}
+	tpl := template.New("")
+	tpl.Funcs(defaultTemplateFuncs)
+	tpl.Funcs(l.funcs)
+	_, err = tpl.ParseFiles(filenames...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse templates: %w", err)
+	}
+	return tpl, nil
+}
+
+// A FSTemplateLoader is a TemplateLoader that loads templates from a fs.FS,
+// e.g. an embed.FS. It uses template.ParseFS() internally.
+// Templates are parsed once and cached.
+type FSTemplateLoader struct {
+	cachedTemplate *template.Template
+	masterTemplate *template.Template // never executed, for Clone()
+}
+
+var _ TemplateCloner = (*FSTemplateLoader)(nil)
+
+func NewFSTemplateLoader(fsys fs.FS, templatesPattern string, funcs template.FuncMap) (TemplateLoader, error) {
+	tpl := template.New("")
+	tpl.Funcs(defaultTemplateFuncs)
+	tpl.Funcs(funcs)
+	_, err := tpl.ParseFS(fsys, templatesPattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse templates: %w", err)
+	}
+	return &FSTemplateLoader{template.Must(tpl.Clone()), tpl}, nil
+}
+
+func (l *FSTemplateLoader) Load() (*template.Template, error) {
+	return l.cachedTemplate, nil
+}
+
+func (l *FSTemplateLoader) Clone() (*template.Template, error) {
+	return l.masterTemplate.Clone()
+}
+
+// A NullTemplateLoader is a TemplateLoader that does nothing.
+// Useful for pure REST apps that do not render HTML templates.
+type NullTemplateLoader struct {
+	err error
+}
+
+var _ TemplateLoader = (*NullTemplateLoader)(nil)
+
+func NewNullTemplateLoader() TemplateLoader {
+	return &NullTemplateLoader{
+		errors.New("NullTemplateLoader cannot Load() anything"),
+	}
+}
+
+func (l *NullTemplateLoader) Load() (*template.Template, error) {
+	return nil, l.err
+}
+
+// A ResponseRenderer renders responses.
+type ResponseRenderer struct {
+	templateLoader TemplateLoader
+	mu             sync.Mutex
+	fsEtags        map[fsEtagKey]string // of fs.FS files without modtime, see fsEtag
+
+	// BodyFilter, if not nil, can modify the body of HTML template and content
+	// responses before it is written, e.g. to inject a script into every page.
+	// Other responses are not filtered.
+	BodyFilter func(contentType string, body []byte) []byte
+
+	// MinifyHtml, if true, minifies the HTML output of template responses
+	// before the BodyFilter is applied, see MinifyHtml.
+	MinifyHtml bool
+
+	// NotFoundHandler, if not nil, writes 404 responses, e.g. a branded error page.
+	// It is called for StatusResponses with code 404 and for unknown response types.
+	NotFoundHandler func(w http.ResponseWriter, req *http.Request)
+
+	// ErrorHandler, if not nil, writes 500 responses, e.g. a branded error page.
+	// It is called for StatusResponses with code 500 and for rendering errors.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, msg string)
+
+	// DefaultHeaders are set on every response, unless the response or
+	// a http.Handler before the renderer has set them, e.g. SecurityHeaders("").
+	DefaultHeaders map[string]string
+
+	// AccessLog, if not nil, is called after each response has been written,
+	// e.g. to log requests with the log or log/slog package.
+	AccessLog func(entry AccessLogEntry)
+}
+
+// An AccessLogEntry describes a rendered response, see ResponseRenderer.AccessLog.
+type AccessLogEntry struct {
+	Request      *http.Request
+	ResponseType ResponseType  // after content negotiation, see NewNegotiatedResponse
+	StatusCode   int           // as written, e.g. 304 for a conditional GET
+	Bytes        int64         // body bytes written
+	Duration     time.Duration // since Request.StartTime, if recorded, or since rendering started
+}
+
+func NewResponseRenderer(templateLoader TemplateLoader) *ResponseRenderer {
+	if templateLoader == nil {
+		panic("no templateLoader")
+	}
+	return &ResponseRenderer{templateLoader: templateLoader}
+}
+
+// Render renders a response
+func (r *ResponseRenderer) Render(w http.ResponseWriter, req *http.Request, response Response) {
+	// rendering errors have been written as 500 responses
+	r.render(w, req, response)
+}
+
+// render renders a response and returns the error that was written as
+// a 500 response, if rendering failed, e.g. because of a template error.
+func (r *ResponseRenderer) render(w http.ResponseWriter, req *http.Request, response Response) error {
+	if r.AccessLog != nil {
+		start, ok := req.Context().Value(startTimeKey).(time.Time)
+		if !ok {
+			start = time.Now()
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			r.AccessLog(AccessLogEntry{req, response.Type, sw.statusCode(), sw.bytes, time.Since(start)})
+		}()
+	}
+	// cookies and headers
+	for _, c := range response.Cookies {
+		http.SetCookie(w, c)
+	}
+	for key, value := range response.Headers {
+		// keep headers of a http.Handler before the renderer, e.g. the
+		// Content-Security-Policy of NewCspNonceHandler
+		if w.Header().Get(key) == "" {
+			w.Header().Set(key, value)
+		}
+	}
+	for key, values := range response.HeaderValues {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	for key, value := range r.DefaultHeaders {
+		if w.Header().Get(key) == "" {
+			w.Header().Set(key, value)
+		}
+	}
+	// content
+	if response.Type == NegotiatedResponse {
+		w.Header().Add("Vary", "Accept")
+		accept := req.Header.Get("Accept")
+		if acceptQuality(accept, "application/json") > acceptQuality(accept, "text/html") {
+			response.Type = JsonResponse
+			response.JsonData = response.TemplateData
+		} else {
+			response.Type = TemplateResponse
+		}
+	}
+	if response.IsZero() {
+		r.notFound(w, req)
+		return nil
+	}
+	switch response.Type {
+	case TemplateResponse:
+		tpl, name, err := r.loadTemplate(req, response)
+		if err != nil {
+			return r.internalError(w, req, err.Error())
+		}
+		// render into a buffer, so that errors yield a clean 500 response
+		// instead of a half-rendered page
+		buf := getBuffer()
+		defer putBuffer(buf)
+		err = tpl.ExecuteTemplate(buf, name, response.TemplateData)
+		if err != nil {
+			return r.internalError(w, req, fmt.Sprintf("cannot render %s: %s", response.templateNames(), err))
+		}
+		body := buf.Bytes()
+		if r.MinifyHtml {
+			if mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mediaType == "" || mediaType == "text/html" {
+				body = MinifyHtml(body)
+			}
+		}
+		if r.BodyFilter != nil {
+			ctype := w.Header().Get("Content-Type")
+			if ctype == "" {
+				ctype = "text/html; charset=utf-8"
+				w.Header().Set("Content-Type", ctype)
+			}
+			body = r.filterBody(ctype, body)
+		}
+		w.WriteHeader(response.statusCodeOr(200))
+		w.Write(body)
+	case JsonResponse:
+		var data []byte
+		var err error
+		if response.JsonIndent != "" {
+			data, err = json.MarshalIndent(response.JsonData, "", response.JsonIndent)
+		} else {
+			data, err = json.Marshal(response.JsonData)
+		}
+		if err != nil {
+			errMsg := fmt.Sprintf("cannot marshal json: %s", err)
+			return r.internalError(w, req, errMsg)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(response.statusCodeOr(200))
+		w.Write(data)
+	case JsonpResponse:
+		if !isJsonpCallback(response.JsonpCallback) {
+			http.Error(w, "invalid jsonp callback", http.StatusBadRequest)
+			return nil
+		}
+		data, err := json.Marshal(response.JsonData)
+		if err != nil {
+			errMsg := fmt.Sprintf("cannot marshal json: %s", err)
+			return r.internalError(w, req, errMsg)
+		}
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		// nosniff and the leading comment keep the body from being used as another content type
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "/**/%s(%s);", response.JsonpCallback, data)
+	case XmlResponse:
+		data, err := xml.Marshal(response.XmlData)
+		if err != nil {
+			errMsg := fmt.Sprintf("cannot marshal xml: %s", err)
+			return r.internalError(w, req, errMsg)
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(response.statusCodeOr(200))
+		io.WriteString(w, xml.Header)
+		w.Write(data)
+	case FileResponse:
+		if response.FileDisposition != "" {
+			w.Header().Set("Content-Disposition", response.FileDisposition)
+		}
+		if response.FileFS != nil {
+			return r.serveFileFS(w, req, response.FileFS, response.FileName, response.FileType)
 		}
-		w.WriteHeader(200)
-		w.Write(data)
-	case FileResponse:
 		if response.FileType != "" {
 			w.Header().Set("Content-Type", response.FileType)
 		}
-		if response.FileDisposition != "" {
-			w.Header().Set("Content-Disposition", response.FileDisposition)
+		if w.Header().Get("Etag") == "" {
+			if info, err := os.Stat(response.FileName); err == nil && !info.IsDir() {
+				w.Header().Set("Etag", fileEtag(info))
+			}
+		}
+		// http.ServeFile handles If-None-Match and If-Modified-Since
+		http.ServeFile(w, req, response.FileName)
+	case ContentResponse:
+		setContentType(w, response.ContentType)
+		if response.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", response.ContentDisposition)
+		}
+		data := r.filterBody(response.ContentType, response.ContentData)
+		if response.StatusCode != 0 {
+			w.WriteHeader(response.StatusCode)
+			w.Write(data)
+			return nil
+		}
+		if w.Header().Get("Etag") == "" {
+			w.Header().Set("Etag", contentEtag(data))
+		}
+		// http.ServeContent handles If-None-Match and single and multi range requests
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+	case SeekableResponse:
+		if closer, ok := response.SeekableContent.(io.Closer); ok {
+			defer closer.Close()
+		}
+		setContentType(w, contentTypeOrExt(response.ContentType, response.SeekableName))
+		if response.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", response.ContentDisposition)
+		}
+		// http.ServeContent handles If-Modified-Since and range requests
+		http.ServeContent(w, req, response.SeekableName, response.SeekableModTime, response.SeekableContent)
+	case RedirectResponse:
+		if isHtmx(req) {
+			// htmx does not follow redirects with a page navigation, HX-Redirect does
+			w.Header().Set("Hx-Redirect", response.RedirectLocation)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+		code := response.StatusCode
+		switch code {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			// e.g. 300 Multiple Choices and 304 Not Modified are no redirects
+			code = http.StatusSeeOther
+		}
+		http.Redirect(w, req, response.RedirectLocation, code)
+	case StatusResponse:
+		if response.StatusCode == http.StatusNotFound && r.NotFoundHandler != nil {
+			r.NotFoundHandler(w, req)
+			return nil
+		}
+		if response.StatusCode == http.StatusInternalServerError && r.ErrorHandler != nil {
+			r.ErrorHandler(w, req, response.StatusText)
+			return nil
+		}
+		w.WriteHeader(response.StatusCode)
+		if response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified {
+			return nil // must not have a body
+		}
+		io.WriteString(w, response.StatusText)
+	case StreamResponse:
+		if closer, ok := response.StreamReader.(io.Closer); ok {
+			defer closer.Close()
+		}
+		setContentType(w, response.ContentType)
+		if response.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", response.ContentDisposition)
+		}
+		w.WriteHeader(response.statusCodeOr(200))
+		_, err := io.Copy(w, response.StreamReader)
+		if err != nil {
+			// headers are already sent, all we can do is log
+			log.Printf("webs: cannot stream response: %s", err)
+		}
+	case JsonLinesResponse:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(200)
+		writeJsonLines(w, response.JsonLines)
+	case CsvResponse:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if response.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", response.ContentDisposition)
+		}
+		w.WriteHeader(200)
+		if err := writeCsv(w, response.CsvHeader, response.CsvRows); err != nil {
+			log.Printf("webs: cannot write csv: %s", err)
+		}
+	default:
+		r.notFound(w, req)
+	}
+	return nil
+}
+
+// setContentType sets the Content-Type header of content, stream, seekable and
+// FS file responses. If ctype and the header are empty, it sets application/octet-stream
+// and forbids content sniffing, so that browsers do not execute uploaded bytes as HTML.
+func setContentType(w http.ResponseWriter, ctype string) {
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	} else if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+}
+
+// contentTypeOrExt returns ctype, or the content type of the file name's extension,
+// like http.ServeContent derives it, but without sniffing the content.
+func contentTypeOrExt(ctype, name string) string {
+	if ctype == "" {
+		return mime.TypeByExtension(path.Ext(name))
+	}
+	return ctype
+}
+
+// serveFileFS writes the file name of fsys with http.ServeContent,
+// see render for the returned error.
+func (r *ResponseRenderer) serveFileFS(w http.ResponseWriter, req *http.Request, fsys fs.FS, name, ctype string) error {
+	f, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		r.notFound(w, req)
+		return nil
+	}
+	if err != nil {
+		return r.internalError(w, req, fmt.Sprintf("cannot open %s: %s", name, err))
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return r.internalError(w, req, fmt.Sprintf("cannot stat %s: %s", name, err))
+	}
+	if info.IsDir() {
+		r.notFound(w, req)
+		return nil
+	}
+	content, seekable := f.(io.ReadSeeker)
+	if !seekable {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return r.internalError(w, req, fmt.Sprintf("cannot read %s: %s", name, err))
+		}
+		content = bytes.NewReader(data)
+	}
+	if w.Header().Get("Etag") == "" {
+		etag, err := r.fsEtag(fsys, name, info, content)
+		if err != nil {
+			return r.internalError(w, req, fmt.Sprintf("cannot read %s: %s", name, err))
+		}
+		w.Header().Set("Etag", etag)
+	}
+	setContentType(w, contentTypeOrExt(ctype, name))
+	// http.ServeContent handles If-None-Match, If-Modified-Since and range requests
+	http.ServeContent(w, req, path.Base(name), info.ModTime(), content)
+	return nil
+}
+
+// fsEtagKey identifies a file of an fs.FS, see fsEtag.
+type fsEtagKey struct {
+	fsys fs.FS
+	name string
+	size int64
+}
+
+// fsEtag returns the ETag of a file of fsys. Like for OS files, it uses size and
+// modification time, if known. Otherwise, e.g. for embed.FS, the content is hashed,
+// and the ETag is cached per file, since such files do not change. The cache
+// is used only if fsys is comparable, as embed.FS and os.DirFS are.
+func (r *ResponseRenderer) fsEtag(fsys fs.FS, name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fileEtag(info), nil
+	}
+	key := fsEtagKey{fsys, name, info.Size()}
+	cacheable := reflect.TypeOf(fsys).Comparable()
+	if cacheable {
+		r.mu.Lock()
+		etag, ok := r.fsEtags[key]
+		r.mu.Unlock()
+		if ok {
+			return etag, nil
+		}
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := contentEtag(data)
+	if cacheable {
+		r.mu.Lock()
+		if r.fsEtags == nil {
+			r.fsEtags = make(map[fsEtagKey]string)
+		}
+		r.fsEtags[key] = etag
+		r.mu.Unlock()
+	}
+	return etag, nil
+}
+
+// RenderToString renders response and returns the body and the status code,
+// e.g. to generate email bodies from templates, or for snapshot tests.
+// It uses the same rendering logic as Render, including the BodyFilter.
+// File and streaming responses are not supported and return an error,
+// as do responses that fail to render, e.g. because of a template error.
+func (r *ResponseRenderer) RenderToString(response Response) (string, int, error) {
+	switch response.Type {
+	case FileResponse, JsonLinesResponse, StreamResponse:
+		return "", 0, fmt.Errorf("cannot render response type %d to string", response.Type)
+	}
+	rec, err := r.renderToRecorder(response)
+	if err != nil {
+		return "", 0, err
+	}
+	return rec.body.String(), rec.statusCode(), nil
+}
+
+// renderToRecorder renders response for a GET request into a recorder.
+// It returns the rendering error, if any.
+func (r *ResponseRenderer) renderToRecorder(response Response) (*responseRecorder, error) {
+	rec := newResponseRecorder()
+	if err := r.render(rec, newRequest("GET", "/"), response); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (r *ResponseRenderer) notFound(w http.ResponseWriter, req *http.Request) {
+	if r.NotFoundHandler != nil {
+		r.NotFoundHandler(w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// internalError writes a 500 response for a rendering error and returns the error.
+func (r *ResponseRenderer) internalError(w http.ResponseWriter, req *http.Request, msg string) error {
+	if r.ErrorHandler != nil {
+		r.ErrorHandler(w, req, msg)
+	} else {
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+	return errors.New(msg)
+}
+
+// responseRecorder is a http.ResponseWriter that records a response in memory,
+// see RenderToString and ResponseRenderer.Record. Like net/http, it sniffs the
+// content type if none is set.
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		if _, ok := w.header["Content-Type"]; !ok && w.body.Len() == 0 {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+// statusCode returns the status code written, or 200 if nothing was written.
+func (w *responseRecorder) statusCode() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// cookies returns the cookies set with Set-Cookie headers.
+func (w *responseRecorder) cookies() []*http.Cookie {
+	return (&http.Response{Header: w.header}).Cookies()
+}
+
+// newRequest creates an incoming request for method and target, like
+// httptest.NewRequest, which production code should not import.
+// The host is example.com, the remote address is 192.0.2.1:1234.
+func newRequest(method, target string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	if err != nil {
+		panic(fmt.Sprintf("invalid request %s %s: %s", method, target, err))
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
+// bufferPool holds buffers for rendering templates.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// maxPooledBufferSize is the maximum capacity of a buffer that is put back
+// into bufferPool, so that a single large page does not pin memory.
+const maxPooledBufferSize = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+// statusWriter is a http.ResponseWriter that records the status code
+// and the number of body bytes written, including those written by
+// NotFoundHandler, ErrorHandler and http.ServeContent.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, so that streaming responses are flushed.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the status code written, or 200 if nothing was written,
+// like net/http does.
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// acceptQuality returns the quality of mediaType in an Accept header,
+// see NewNegotiatedResponse.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, 0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		spec := 0
+		switch rangeType {
+		case mediaType:
+			spec = 3
+		case typ + "/*":
+			spec = 2
+		case "*/*":
+			spec = 1
+		}
+		if spec <= specificity {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, spec
+	}
+	return quality
+}
+
+// contentEtag returns a strong ETag for data.
+func contentEtag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("\"%x\"", sum[:16])
+}
+
+// fileEtag returns a weak ETag for a file. It does not read the file
+// but uses size and modification time.
+func fileEtag(info fs.FileInfo) string {
+	return fmt.Sprintf("W/\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
+// csvFlushRows is the number of CSV rows after which writeCsv flushes.
+const csvFlushRows = 1000
+
+// writeCsv writes a header and rows as CSV. It flushes every csvFlushRows rows,
+// so browsers can show the download progress.
+func writeCsv(w http.ResponseWriter, header []string, rows CsvRowsFunc) error {
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	if header != nil {
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+	}
+	count := 0
+	err := rows(func(row []string) error {
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+		count++
+		if count%csvFlushRows == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJsonLines writes records as ndjson. It flushes whenever no
+// record is immediately available, so clients can process records incrementally.
+func writeJsonLines(w http.ResponseWriter, records <-chan any) {
+	flusher, _ := w.(http.Flusher)
+	var writeErr error
+	for {
+		var record any
+		var ok bool
+		select {
+		case record, ok = <-records:
+		default:
+			if flusher != nil && writeErr == nil {
+				flusher.Flush()
+			}
+			record, ok = <-records
+		}
+		if !ok {
+			break
+		}
+		if writeErr != nil {
+			continue // drain records so that the producer does not block forever
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("webs: cannot marshal json line: %s", err)
+			continue
+		}
+		_, writeErr = w.Write(append(data, '\n'))
+	}
+	if flusher != nil && writeErr == nil {
+		flusher.Flush()
+	}
+}
+
+// A Router is a http.Handler that dispatches requests to handler funcs
+// by method and path and renders their responses with a ResponseRenderer.
+type Router struct {
+	renderer    *ResponseRenderer
+	routes      []route
+	notFound    func(Request) Response
+	middlewares []Middleware
+
+	// MethodOverride, if true, lets HTML forms use PUT, PATCH and DELETE routes:
+	// For POST requests with a form field _method=PUT, PATCH or DELETE,
+	// the request method is replaced before routing, so that Request.Method
+	// returns the overridden method.
+	MethodOverride bool
+}
+
+var _ http.Handler = (*Router)(nil)
+
+// route is a handler registered in a Router.
+type route struct {
+	method   string   // empty for all methods
+	segments []string // path segments, ":name" for path parameters
+	handler  func(Request) Response
+}
+
+func NewRouter(renderer *ResponseRenderer) *Router {
+	if renderer == nil {
+		panic("no renderer")
+	}
+	return &Router{renderer: renderer}
+}
+
+// Handle registers a handler for a pattern. A pattern is a path, optionally
+// preceded by a method and a space, e.g. "/about" or "POST /login".
+// Routes with a GET method also match HEAD requests.
+// A path segment that starts with a colon is a path parameter that matches
+// any single segment, e.g. "GET /user/:id", see Request.Param.
+// Routes are matched in the order they were registered, so "/user/new"
+// must be registered before "/user/:id". A pattern registered twice
+// replaces the previous handler.
+func (rt *Router) Handle(pattern string, handler func(Request) Response) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	newRoute := route{method: method, segments: strings.Split(strings.TrimSpace(path), "/"), handler: handler}
+	for i, rte := range rt.routes {
+		if rte.method == newRoute.method && strings.Join(rte.segments, "/") == strings.Join(newRoute.segments, "/") {
+			rt.routes[i] = newRoute
+			return
+		}
+	}
+	rt.routes = append(rt.routes, newRoute)
+}
+
+// NotFound registers a fallback handler for paths that match no route,
+// e.g. to serve index.html of a single page app. Without a fallback handler,
+// unmatched paths get a 404 response.
+func (rt *Router) NotFound(handler func(Request) Response) {
+	rt.notFound = handler
+}
+
+// Use adds middlewares that wrap all route handlers and the NotFound handler.
+// Middlewares run in the order they were added.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+}
+
+// ServeHTTP dispatches to the first matching route. If a route matches
+// the path but not the method, the response is 405 Method Not Allowed.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.MethodOverride && r.Method == "POST" {
+		r = overrideMethod(r)
+	}
+	var res Response // the zero Response renders as 404
+	var allowed []string
+	segments := strings.Split(r.URL.Path, "/")
+	for _, rte := range rt.routes {
+		params, ok := rte.match(segments)
+		if !ok {
+			continue
+		}
+		if rte.method != "" && rte.method != r.Method && !(rte.method == "GET" && r.Method == "HEAD") {
+			if !containsFold(allowed, rte.method) {
+				allowed = append(allowed, rte.method)
+			}
+			continue
+		}
+		if len(params) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), paramsKey, params))
+		}
+		rt.renderer.Render(w, r, Chain(rte.handler, rt.middlewares...)(NewRequest(r)))
+		return
+	}
+	if len(allowed) > 0 {
+		res = NewStatusResponse(http.StatusMethodNotAllowed, "method not allowed").WithHeader("Allow", strings.Join(allowed, ", "))
+	} else if rt.notFound != nil {
+		res = Chain(rt.notFound, rt.middlewares...)(NewRequest(r))
+	}
+	rt.renderer.Render(w, r, res)
+}
+
+// overrideMethod returns a copy of r with the method from the _method form field,
+// or r if there is no valid override.
+func overrideMethod(r *http.Request) *http.Request {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if r.ParseForm() != nil {
+			return r
+		}
+	case "multipart/form-data":
+		if parseMultipartForm(r) != nil {
+			return r
+		}
+	default:
+		return r
+	}
+	method := strings.ToUpper(r.PostForm.Get("_method"))
+	switch method {
+	case "PUT", "PATCH", "DELETE":
+		r = r.WithContext(r.Context())
+		r.Method = method
+	}
+	return r
+}
+
+// match returns the path parameters if the route matches the path segments.
+func (rte route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rte.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range rte.segments {
+		if strings.HasPrefix(seg, ":") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[1:]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// A Middleware wraps the invocation of a handler, e.g. for logging or
+// authentication. It can return a response without calling next,
+// or call next and modify the response.
+type Middleware func(req Request, next func(Request) Response) Response
+
+// Chain wraps a handler with middlewares. The first middleware is the
+// outermost, i.e. it is called first and sees the final response.
+func Chain(handler func(Request) Response, middlewares ...Middleware) func(Request) Response {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		mw, next := middlewares[i], handler
+		handler = func(req Request) Response {
+			return mw(req, next)
+		}
+	}
+	return handler
+}
+
+// RecoverMiddleware is a Middleware that recovers from panics in next.
+// It logs the panic and returns status 500.
+func RecoverMiddleware(req Request, next func(Request) Response) (res Response) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("recovered from panic: %v", v)
+			res = NewStatusInternalServerErrorResponse("internal server error")
+		}
+	}()
+	return next(req)
+}
+
+// Serve runs server with ListenAndServe until the process receives SIGINT or
+// SIGTERM, then shuts it down gracefully: it stops accepting connections and
+// waits up to grace for in-flight requests to complete. Afterwards, background
+// cleanup of stores that are SessionCleaners is stopped, so that no session
+// file is written while the process exits. FileSessionStore writes sessions
+// on each Save, so there is nothing else to flush.
+// Serve returns nil after a clean shutdown, so main can exit normally.
+func Serve(server *http.Server, grace time.Duration, stores ...SessionStore) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	return serveUntil(server, server.ListenAndServe, stop, grace, stores)
+}
+
+// serveUntil implements Serve: it calls listen and shuts server down when
+// stop receives a signal.
+func serveUntil(server *http.Server, listen func() error, stop <-chan os.Signal, grace time.Duration, stores []SessionStore) error {
+	defer func() {
+		for _, store := range stores {
+			if cleaner, ok := store.(SessionCleaner); ok {
+				cleaner.StopCleanup()
+			}
+		}
+	}()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listen()
+	}()
+	select {
+	case err := <-errc:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case sig := <-stop:
+		log.Printf("webs: received %s, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	<-errc // returns http.ErrServerClosed as soon as Shutdown is called
+	if err != nil {
+		return fmt.Errorf("cannot shut down gracefully: %w", err)
+	}
+	return nil
+}
+
+// NewCleanPathHandler returns a http.Handler that cleans the request path
+// before calling next: duplicate slashes are collapsed and . and .. elements
+// are resolved, so that a path cannot escape the root. A trailing slash is kept.
+// If redirect is true, GET and HEAD requests for unclean paths are redirected
+// with 301 Moved Permanently to the clean path, keeping the query string.
+func NewCleanPathHandler(next http.Handler, redirect bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clean := cleanPath(r.URL.Path)
+		if clean == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if redirect && (r.Method == "GET" || r.Method == "HEAD") {
+			u := *r.URL
+			u.Path = clean
+			u.RawPath = ""
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = clean
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// cleanPath returns the canonical form of p, see NewCleanPathHandler.
+func cleanPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Cors configures cross-origin resource sharing, see NewCorsHandler.
+type Cors struct {
+	// AllowedOrigins are the origins that may access resources,
+	// e.g. "https://app.example.com", or "*" for all origins.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in preflight requests.
+	// If empty, GET, HEAD and POST are allowed.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed in preflight requests,
+	// or "*" to allow all requested headers.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers that clients may read,
+	// in addition to the CORS-safelisted ones.
+	ExposedHeaders []string
+	// AllowCredentials allows requests with cookies and HTTP authentication.
+	AllowCredentials bool
+	// MaxAge is how long clients may cache the result of a preflight request.
+	// If zero, clients use their default.
+	MaxAge time.Duration
+}
+
+// NewCorsHandler returns a http.Handler that sets the Access-Control-* headers
+// for requests from allowed origins before calling next.
+// The requesting origin is reflected in Access-Control-Allow-Origin, so that
+// several origins can be allowed, and credentials can be allowed, for
+// which browsers do not accept "*". If AllowedOrigins contains "*", a literal "*"
+// is sent instead; NewCorsHandler panics if "*" is combined with AllowCredentials,
+// since that would allow any site to make authenticated requests.
+// Preflight requests, i.e. OPTIONS requests
+// with an Access-Control-Request-Method header, are answered with 204 No Content
+// and not passed to next. Requests from other origins are passed to next
+// without CORS headers, so browsers will block them.
+func NewCorsHandler(next http.Handler, cors Cors) http.Handler {
+	methods := cors.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+	wildcard := containsFold(cors.AllowedOrigins, "*")
+	if wildcard && cors.AllowCredentials {
+		panic("cors: AllowedOrigins \"*\" must not be combined with AllowCredentials")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// the response depends on the origin, so caches must not mix them up
+			w.Header().Add("Vary", "Origin")
+			if !containsFold(cors.AllowedOrigins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if len(cors.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			if containsFold(cors.AllowedHeaders, "*") {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			} else if len(cors.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			}
+		}
+		if cors.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// containsFold returns true if values contains s, ignoring case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBody applies the BodyFilter, if any, to HTML bodies.
+func (r *ResponseRenderer) filterBody(contentType string, body []byte) []byte {
+	if r.BodyFilter == nil {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" {
+		return body
+	}
+	return r.BodyFilter(contentType, body)
+}
+
+// MinifyHtml returns a minified copy of html: comments are removed and
+// runs of whitespace are collapsed into a single space. The content of
+// pre, textarea, script and style elements and quoted attribute values
+// are kept as they are, since whitespace is significant there.
+func MinifyHtml(html []byte) []byte {
+	out := make([]byte, 0, len(html))
+	for i := 0; i < len(html); {
+		c := html[i]
+		switch {
+		case bytes.HasPrefix(html[i:], []byte("<!--")):
+			end := bytes.Index(html[i+4:], []byte("-->"))
+			if end < 0 {
+				// not a complete comment, keep the rest unchanged
+				return append(out, html[i:]...)
+			}
+			i += 4 + end + 3
+		case c == '<' && i+1 < len(html) && (isAsciiLetter(html[i+1]) || html[i+1] == '/' || html[i+1] == '!'):
+			start := i
+			out, i = appendMinifiedTag(out, html, i)
+			if name := rawTextElement(html[start:i]); name != "" {
+				end := indexFold(html[i:], "</"+name)
+				if end < 0 {
+					return append(out, html[i:]...)
+				}
+				out = append(out, html[i:i+end]...)
+				i += end
+			}
+		case isHtmlSpace(c):
+			for i < len(html) && isHtmlSpace(html[i]) {
+				i++
+			}
+			if len(out) == 0 || out[len(out)-1] != ' ' {
+				out = append(out, ' ')
+			}
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return out
+}
+
+// appendMinifiedTag appends the tag that starts at html[i] to out, with runs of
+// whitespace outside of quoted attribute values collapsed, and returns
+// out and the index after the tag.
+func appendMinifiedTag(out, html []byte, i int) ([]byte, int) {
+	var quote byte
+	for i < len(html) {
+		c := html[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return append(out, c), i + 1
+		case isHtmlSpace(c):
+			for i+1 < len(html) && isHtmlSpace(html[i+1]) {
+				i++
+			}
+			c = ' '
+		}
+		out = append(out, c)
+		i++
+	}
+	return out, i
+}
+
+// rawTextElement returns the lowercase name of a start tag whose content
+// must not be minified, or empty string.
+func rawTextElement(tag []byte) string {
+	n := 1
+	for n < len(tag) && !isHtmlSpace(tag[n]) && tag[n] != '>' && tag[n] != '/' {
+		n++
+	}
+	switch name := strings.ToLower(string(tag[1:n])); name {
+	case "pre", "textarea", "script", "style":
+		return name
+	}
+	return ""
+}
+
+// indexFold returns the index of the first occurrence of the ASCII string sub
+// in s, ignoring case, or -1 if not found.
+func indexFold(s []byte, sub string) int {
+	b := []byte(sub)
+	for i := 0; i+len(b) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(b)], b) {
+			return i
 		}
-		http.ServeFile(w, req, response.FileName)
-	case ContentResponse:
-		if response.ContentType != "" {
-			w.Header().Set("Content-Type", response.ContentType)
+	}
+	return -1
+}
+
+func isAsciiLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isHtmlSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// loadTemplate loads the template set for a TemplateResponse and returns it
+// together with the name of the template to execute.
+func (r *ResponseRenderer) loadTemplate(req *http.Request, response Response) (*template.Template, string, error) {
+	nonce, _ := req.Context().Value(cspNonceKey).(string)
+	if response.LayoutName == "" && nonce == "" && len(response.TemplateFuncs) == 0 {
+		tpl, err := r.templateLoader.Load()
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot load templates: %w", err)
 		}
-		if response.ContentDisposition != "" {
-			w.Header().Set("Content-Disposition", response.ContentDisposition)
+		return tpl, response.TemplateName, nil
+	}
+	// layouts and per-request funcs modify the template set, so we need a copy
+	var tpl *template.Template
+	var err error
+	if cloner, ok := r.templateLoader.(TemplateCloner); ok {
+		tpl, err = cloner.Clone()
+	} else {
+		tpl, err = r.templateLoader.Load()
+		if err == nil {
+			tpl, err = tpl.Clone()
 		}
-		w.Write(response.ContentData)
-	case RedirectResponse:
-		http.Redirect(w, req, response.RedirectLocation, http.StatusSeeOther)
-	case StatusResponse:
-		w.WriteHeader(response.StatusCode)
-		io.WriteString(w, response.StatusText)
-	default:
-		http.NotFound(w, req)
 	}
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot load templates: %w", err)
+	}
+	if nonce != "" {
+		tpl.Funcs(template.FuncMap{"cspNonce": func() string { return nonce }})
+	}
+	if len(response.TemplateFuncs) > 0 {
+		tpl.Funcs(response.TemplateFuncs)
+	}
+	if response.LayoutName == "" {
+		return tpl, response.TemplateName, nil
+	}
+	if tpl.Lookup(response.LayoutName) == nil {
+		return nil, "", fmt.Errorf("cannot render %s: layout template %q not found", response.templateNames(), response.LayoutName)
+	}
+	content := tpl.Lookup(response.TemplateName)
+	if content == nil {
+		return nil, "", fmt.Errorf("cannot render %s: content template %q not found", response.templateNames(), response.TemplateName)
+	}
+	_, err = tpl.AddParseTree("content", content.Tree)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot render %s: %w", response.templateNames(), err)
+	}
+	return tpl, response.LayoutName, nil
 }
 
 // M holds template data
@@ -381,21 +3044,184 @@ func (p PageParams) Get(key string) any {
 
 // Session is a user session.
 type Session struct {
-	id     string
-	values map[string]string
+	id       string
+	values   map[string]string
+	created  time.Time
+	expires  time.Time // zero means never
+	accessed time.Time // zero means never touched
+	// idLength and idAlphabet are used by Regenerate, zero means 32 hex characters
+	idLength   int
+	idAlphabet string
 }
 
-// NewSession creates a new session with a unique random id.
-// Before Go 1.20, you must call rand.Seed() before calling NewSession.
+// NewSession creates a new session with a unique random id of 32 hex characters.
+// The session never expires.
+// It panics if the system's secure random number generator fails,
+// use NewSessionWithConfig to handle that error.
 func NewSession() Session {
-	const chars = "0123456789abcdef"
-	buf := make([]byte, 32)
-	for i := range buf {
-		n := rand.Intn(16)
-		x := chars[n]
-		buf[i] = x
+	id, err := newSessionId(32, SessionIdHex)
+	if err != nil {
+		panic(err)
+	}
+	return Session{id: id, values: make(map[string]string), created: time.Now()}
+}
+
+// NewSessionWithTTL creates a new session that expires after ttl.
+func NewSessionWithTTL(ttl time.Duration) Session {
+	s := NewSession()
+	s.expires = s.created.Add(ttl)
+	return s
+}
+
+// Alphabets for session ids, see SessionConfig.
+const (
+	SessionIdHex          = "0123456789abcdef"
+	SessionIdAlphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	SessionIdBase64Url    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+// minSessionIdBits is the minimum entropy of session ids, as of NewSession.
+const minSessionIdBits = 128
+
+// SessionConfig configures the sessions of NewSessionWithConfig.
+type SessionConfig struct {
+	// IdLength is the number of characters of the session id.
+	IdLength int
+	// IdAlphabet are the characters of the session id, e.g. SessionIdBase64Url.
+	// It must have at least 16 distinct characters, which must be ASCII letters,
+	// digits, '-', '_', '.' or '~', so that ids are safe in cookies and URLs.
+	IdAlphabet string
+	// TTL, if not zero, is the time after which the session expires.
+	TTL time.Duration
+}
+
+// Validate returns an error if the alphabet is invalid or if ids have less
+// than 128 bits of entropy, e.g. at least 32 hex or 22 base64url characters.
+func (c SessionConfig) Validate() error {
+	if len(c.IdAlphabet) < 16 {
+		return fmt.Errorf("invalid session config: alphabet must have at least 16 characters, has %d", len(c.IdAlphabet))
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < len(c.IdAlphabet); i++ {
+		ch := c.IdAlphabet[i]
+		if !isAsciiLetter(ch) && !('0' <= ch && ch <= '9') && !strings.ContainsRune("-_.~", rune(ch)) {
+			return fmt.Errorf("invalid session config: alphabet contains invalid character %q", ch)
+		}
+		if seen[ch] {
+			return fmt.Errorf("invalid session config: alphabet contains %q twice", ch)
+		}
+		seen[ch] = true
+	}
+	if bits := float64(c.IdLength) * math.Log2(float64(len(c.IdAlphabet))); bits < minSessionIdBits {
+		return fmt.Errorf("invalid session config: ids of length %d have %.0f bits of entropy, must have at least %d", c.IdLength, bits, minSessionIdBits)
+	}
+	return nil
+}
+
+// NewSessionWithConfig creates a new session with a random id of the configured
+// length and alphabet, e.g. to match the constraints of an external system.
+// It returns an error if config is invalid, see SessionConfig.Validate.
+// Session.Regenerate creates ids with the same config, stores do not persist it,
+// see SessionManager.SessionConfig.
+func NewSessionWithConfig(config SessionConfig) (Session, error) {
+	if err := config.Validate(); err != nil {
+		return Session{}, err
+	}
+	id, err := newSessionId(config.IdLength, config.IdAlphabet)
+	if err != nil {
+		return Session{}, err
+	}
+	s := Session{id: id, values: make(map[string]string), created: time.Now()}.withIdConfig(config)
+	if config.TTL != 0 {
+		s.expires = s.created.Add(config.TTL)
+	}
+	return s, nil
+}
+
+// withIdConfig returns s with the id length and alphabet of config,
+// to be used by Regenerate.
+func (s Session) withIdConfig(config SessionConfig) Session {
+	s.idLength = config.IdLength
+	s.idAlphabet = config.IdAlphabet
+	return s
+}
+
+// newSessionId returns a random id of length characters of alphabet,
+// using the system's secure random number generator.
+func newSessionId(length int, alphabet string) (string, error) {
+	// accept only random bytes below a multiple of the alphabet size,
+	// so that all characters are equally likely
+	limit := 256 - 256%len(alphabet)
+	id := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(id) < length {
+		if _, err := crand.Read(buf); err != nil {
+			return "", fmt.Errorf("cannot generate session id: %w", err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < length {
+				id = append(id, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(id), nil
+}
+
+// Regenerate returns a copy of s with a new random id, e.g. after a login
+// to prevent session fixation. Values and timestamps are kept.
+// The new id has the length and alphabet of s, if created with NewSessionWithConfig,
+// or 32 hex characters.
+// Use RegenerateSession or SessionManager.Wrap to replace the session in a store,
+// and set the session cookie to the new id.
+func (s Session) Regenerate() (Session, error) {
+	length, alphabet := 32, SessionIdHex
+	if s.idLength != 0 {
+		length, alphabet = s.idLength, s.idAlphabet
+	}
+	id, err := newSessionId(length, alphabet)
+	if err != nil {
+		return Session{}, err
+	}
+	s = s.clone()
+	s.id = id
+	return s, nil
+}
+
+// RegenerateSession replaces session in store with a copy with a new id,
+// see Session.Regenerate. The new session is saved before the old one is deleted,
+// so that concurrent requests always find one of them. The caller must set
+// the session cookie to the new id.
+// Since stores have no transactions, this is not atomic: if the old session
+// cannot be deleted, the new one is deleted again, and the old session is
+// returned together with the error, so that the caller can keep using it.
+func RegenerateSession(store SessionStore, session Session) (Session, error) {
+	newSession, err := session.Regenerate()
+	if err != nil {
+		return session, err
 	}
-	return Session{string(buf), make(map[string]string)}
+	if err := store.Save(newSession); err != nil {
+		return session, err
+	}
+	if err := store.Delete(session.Id()); err != nil {
+		if rollbackErr := store.Delete(newSession.Id()); rollbackErr != nil {
+			return session, fmt.Errorf("cannot delete old session: %w, cannot delete new session: %s", err, rollbackErr)
+		}
+		return session, fmt.Errorf("cannot delete old session: %w", err)
+	}
+	return newSession, nil
+}
+
+// clone returns a copy of s that does not share the values map with s.
+// Stores keep and return clones, so that callers never alias a store's state.
+func (s Session) clone() Session {
+	if s.values != nil {
+		newValues := make(map[string]string, len(s.values))
+		for k, v := range s.values {
+			newValues[k] = v
+		}
+		s.values = newValues
+	}
+	return s
 }
 
 // IsZero returns true if s has an empty id.
@@ -404,6 +3230,110 @@ func (s Session) IsZero() bool { return s.id == "" }
 // Id returns the session id.
 func (s Session) Id() string { return s.id }
 
+// Equal returns true if s and other have the same id, values and timestamps.
+func (s Session) Equal(other Session) bool {
+	if s.id != other.id || !s.created.Equal(other.created) || !s.expires.Equal(other.expires) || !s.accessed.Equal(other.accessed) {
+		return false
+	}
+	if len(s.values) != len(other.values) {
+		return false
+	}
+	for k, v := range s.values {
+		if ov, ok := other.values[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// CreatedAt returns the creation time.
+func (s Session) CreatedAt() time.Time { return s.created }
+
+// ExpiresAt returns the expiry time, or zero time if the session never expires.
+func (s Session) ExpiresAt() time.Time { return s.expires }
+
+// LastAccessedAt returns the time of the last Touch, or zero time if s was never touched.
+func (s Session) LastAccessedAt() time.Time { return s.accessed }
+
+// Touch returns a copy of s with the last accessed time set to now, which the
+// caller must save. Finding a session does not touch it, so that checking
+// IsIdle does not reset the idle timer, see SessionManager.IdleTimeout.
+func (s Session) Touch() Session {
+	s.accessed = time.Now()
+	return s
+}
+
+// IsIdle returns true if s has not been touched for d. Sessions that were
+// never touched are idle if they were created more than d ago.
+func (s Session) IsIdle(d time.Duration) bool {
+	last := s.accessed
+	if last.IsZero() {
+		last = s.created
+	}
+	return time.Since(last) >= d
+}
+
+// IsExpired returns true if s has an expiry time that has passed.
+func (s Session) IsExpired() bool {
+	return !s.expires.IsZero() && !time.Now().Before(s.expires)
+}
+
+// FlashesKey is the reserved session value key that holds flash messages.
+// Do not use it with WithValue. Session.Keys does not return it.
+const FlashesKey = "_flashes"
+
+// AddFlash returns a copy of s with a flash message added. Flash messages are
+// one-time messages, e.g. "saved successfully", that are shown after a redirect.
+func (s Session) AddFlash(msg string) Session {
+	flashes := s.peekFlashes()
+	flashes = append(flashes, msg)
+	data, _ := json.Marshal(flashes) // cannot fail for []string
+	return s.WithValue(FlashesKey, string(data))
+}
+
+// Flashes returns the pending flash messages, and a copy of s without them.
+// The caller must save the returned session, so that the messages are shown only once.
+func (s Session) Flashes() ([]string, Session) {
+	return s.peekFlashes(), s.WithoutValue(FlashesKey)
+}
+
+// peekFlashes returns the pending flash messages without clearing them.
+func (s Session) peekFlashes() []string {
+	var flashes []string
+	data := s.Get(FlashesKey, "")
+	if data != "" {
+		json.Unmarshal([]byte(data), &flashes) // ignore invalid data
+	}
+	return flashes
+}
+
+// CsrfTokenKey is the reserved session value key that holds the CSRF token.
+// Do not use it with WithValue. Session.Keys does not return it.
+const CsrfTokenKey = "_csrf"
+
+// CsrfToken returns the session's CSRF token, and the session.
+// If the session has no token yet, a new one is created and a copy of s
+// with the token is returned, which the caller must save.
+// Embed the token in forms as a hidden field and check it with ValidateCsrf.
+func (s Session) CsrfToken() (string, Session) {
+	token := s.Get(CsrfTokenKey, "")
+	if token != "" {
+		return token, s
+	}
+	token = GenerateToken(32)
+	return token, s.WithValue(CsrfTokenKey, token)
+}
+
+// ValidateCsrf returns true if submitted matches the session's CSRF token.
+// It uses a constant-time comparison and returns false if the session has no token.
+func ValidateCsrf(session Session, submitted string) bool {
+	token := session.Get(CsrfTokenKey, "")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) == 1
+}
+
 func (s Session) WithValue(key, value string) Session {
 	newValues := make(map[string]string, len(s.values))
 	for k, v := range s.values {
@@ -414,6 +3344,35 @@ func (s Session) WithValue(key, value string) Session {
 	return s
 }
 
+// WithValues returns a copy of s with all values set. It copies the values
+// only once, so it is faster than calling WithValue for each key.
+func (s Session) WithValues(values map[string]string) Session {
+	newValues := make(map[string]string, len(s.values)+len(values))
+	for k, v := range s.values {
+		newValues[k] = v
+	}
+	for k, v := range values {
+		newValues[k] = v
+	}
+	s.values = newValues
+	return s
+}
+
+// WithoutValue returns a copy of s with the value for key removed.
+func (s Session) WithoutValue(key string) Session {
+	if _, ok := s.values[key]; !ok {
+		return s
+	}
+	newValues := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		if k != key {
+			newValues[k] = v
+		}
+	}
+	s.values = newValues
+	return s
+}
+
 func (s Session) Get(key, defValue string) string {
 	if s.values == nil {
 		return defValue
@@ -425,21 +3384,468 @@ func (s Session) Get(key, defValue string) string {
 	return v
 }
 
+// GetInt returns the value for key as int, or defValue if not found or not a valid int.
+func (s Session) GetInt(key string, defValue int) int {
+	return parseInt(s.Get(key, ""), defValue)
+}
+
+// GetBool returns the value for key as bool, or defValue if not found or not a valid bool.
+// Values are parsed like Request.QueryBool.
+func (s Session) GetBool(key string, defValue bool) bool {
+	return parseBool(s.Get(key, ""), defValue)
+}
+
+// WithInt returns a copy of s with an int value, stored as string.
+func (s Session) WithInt(key string, value int) Session {
+	return s.WithValue(key, strconv.Itoa(value))
+}
+
+// WithBool returns a copy of s with a bool value, stored as "true" or "false".
+func (s Session) WithBool(key string, value bool) Session {
+	return s.WithValue(key, strconv.FormatBool(value))
+}
+
+// Keys returns the sorted keys of the session's values, without the
+// reserved keys FlashesKey and CsrfTokenKey, e.g. to list sessions in an admin page.
 func (s Session) Keys() []string {
 	var keys []string
 	for k := range s.values {
-		keys = append(keys, k)
+		if k != FlashesKey && k != CsrfTokenKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A SessionManager finds and saves sessions in a SessionStore and sets the
+// session id cookie with secure attributes.
+// Its exported fields configure the session cookie and can be changed
+// after NewSessionManager, before the manager is used.
+type SessionManager struct {
+	Store          SessionStore
+	CookieName     string
+	CookiePath     string
+	CookieDomain   string
+	CookieSameSite http.SameSite
+	CookieSecure   bool
+	CookieHttpOnly bool
+	// TTL is the cookie Max-Age, 0 means a browser session cookie.
+	// If not 0, new sessions also expire after TTL in the Store,
+	// unless SessionConfig has a TTL.
+	TTL time.Duration
+	// IdleTimeout, if not 0, makes sessions expire after a period of inactivity:
+	// Find deletes idle sessions and returns a zero Session, see Session.IsIdle, and
+	// Wrap touches and therefore saves the session on each request.
+	IdleTimeout time.Duration
+	// SessionConfig, if its IdLength is not 0, configures the ids of the
+	// sessions that Wrap creates and regenerates, see NewSessionWithConfig.
+	// Its TTL, if not 0, is used for new sessions, also if IdLength is 0.
+	SessionConfig SessionConfig
+}
+
+// NewSessionManager creates a SessionManager with cookie path "/",
+// SameSite=Lax and HttpOnly. CookieSecure is false, set it to true
+// for apps served over https.
+func NewSessionManager(store SessionStore, cookieName string, ttl time.Duration) *SessionManager {
+	return &SessionManager{
+		Store:          store,
+		CookieName:     cookieName,
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteLaxMode,
+		CookieHttpOnly: true,
+		TTL:            ttl,
+	}
+}
+
+// Find returns the session for the request's session cookie, or a zero Session if not found.
+func (m *SessionManager) Find(req Request) Session {
+	id := req.CookieValue(m.CookieName, "")
+	if id == "" {
+		return Session{}
+	}
+	session := m.Store.Find(id)
+	if m.IdleTimeout > 0 && !session.IsZero() && session.IsIdle(m.IdleTimeout) {
+		// an idle session is never found again, so remove it from the store
+		if err := m.Store.Delete(session.Id()); err != nil {
+			log.Printf("webs: cannot delete idle session: %s", err)
+		}
+		return Session{}
+	}
+	return session
+}
+
+// Save saves the session and sets the session cookie on the response.
+func (m *SessionManager) Save(res Response, session Session) (Response, error) {
+	if err := m.Store.Save(session); err != nil {
+		return res, err
+	}
+	return res.WithCookieOpts(m.CookieName, session.Id(), m.TTL, m.cookieOptions()), nil
+}
+
+// Delete deletes the request's session, if any, and clears the session cookie on the response.
+func (m *SessionManager) Delete(req Request, res Response) (Response, error) {
+	id := req.CookieValue(m.CookieName, "")
+	if id != "" {
+		if err := m.Store.Delete(id); err != nil {
+			return res, err
+		}
+	}
+	return res.WithCookieOpts(m.CookieName, "", -1, m.cookieOptions()), nil
+}
+
+// Wrap returns a handler that finds the request's session and passes a pointer
+// to it to handler. The handler may modify the session any number of times.
+// After the handler returns, the session is saved once, if it has changed, and
+// the session cookie is set. If the handler sets the session to a zero Session,
+// the session is deleted and the cookie is cleared. If the handler
+// regenerates the session, see Session.Regenerate, the old session is deleted.
+// If the request has no session, handler gets a new session that is only
+// saved if the handler changes it.
+func (m *SessionManager) Wrap(handler func(req Request, session *Session) Response) func(Request) Response {
+	return sessionWrapper{
+		find: func(req Request) Session {
+			session := m.Find(req)
+			if !session.IsZero() && m.SessionConfig.IdLength != 0 {
+				// stores do not persist the id config, see Session.Regenerate
+				session = session.withIdConfig(m.SessionConfig)
+			}
+			return session
+		},
+		create: m.newSession,
+		touch:  m.IdleTimeout > 0,
+		save: func(req Request, res Response, original, session Session) (Response, error) {
+			if session.IsZero() {
+				return m.Delete(req, res)
+			}
+			res, err := m.Save(res, session)
+			if err == nil && session.Id() != original.Id() {
+				err = m.Store.Delete(original.Id())
+			}
+			return res, err
+		},
+	}.wrap(handler)
+}
+
+// sessionWrapper holds the store specific steps of SessionManager.Wrap
+// and CookieSessionStore.Wrap.
+type sessionWrapper struct {
+	find   func(req Request) Session // returns a zero Session if not found
+	create func() (Session, error)
+	touch  bool // touch found and changed sessions, see SessionManager.IdleTimeout
+	// save saves a changed session, or deletes it if session is zero
+	save func(req Request, res Response, original, session Session) (Response, error)
+}
+
+// wrap implements Wrap, see SessionManager.Wrap.
+func (sw sessionWrapper) wrap(handler func(req Request, session *Session) Response) func(Request) Response {
+	return func(req Request) Response {
+		original := sw.find(req)
+		found := !original.IsZero()
+		if !found {
+			var err error
+			original, err = sw.create()
+			if err != nil {
+				return NewStatusInternalServerErrorResponse("cannot create session: %s", err)
+			}
+		}
+		session := original
+		res := handler(req, &session)
+		if sw.touch && !session.IsZero() && (found || !session.Equal(original)) {
+			session = session.Touch()
+		}
+		if session.Equal(original) {
+			return res
+		}
+		res, err := sw.save(req, res, original, session)
+		if err != nil {
+			return NewStatusInternalServerErrorResponse("cannot save session: %s", err)
+		}
+		return res
+	}
+}
+
+// Update finds the request's session, or creates a new one, and replaces it
+// with the result of update. If the session has changed, it is saved and
+// the session cookie is set on res, e.g. a redirect after a form post:
+//
+//	res := NewRedirectResponse("/")
+//	return sessions.Update(req, res, func(session Session) Session {
+//		return session.WithValue("name", req.PostForm("name"))
+//	})
+//
+// Like in Wrap, update may return a regenerated session, whose old id is deleted,
+// or a zero Session to delete the session. If saving fails, status 500 is returned.
+func (m *SessionManager) Update(req Request, res Response, update func(session Session) Session) Response {
+	return m.Wrap(func(req Request, session *Session) Response {
+		*session = update(*session)
+		return res
+	})(req)
+}
+
+// newSession creates a session with the manager's SessionConfig, if set.
+func (m *SessionManager) newSession() (Session, error) {
+	config := m.SessionConfig
+	if config.TTL == 0 {
+		config.TTL = m.TTL
+	}
+	if config.IdLength != 0 {
+		return NewSessionWithConfig(config)
+	}
+	if config.TTL != 0 {
+		return NewSessionWithTTL(config.TTL), nil
+	}
+	return NewSession(), nil
+}
+
+func (m *SessionManager) cookieOptions() CookieOptions {
+	return CookieOptions{
+		Path:     m.CookiePath,
+		Domain:   m.CookieDomain,
+		Secure:   m.CookieSecure,
+		HttpOnly: m.CookieHttpOnly,
+		SameSite: m.CookieSameSite,
+	}
+}
+
+// ErrSessionTooLarge is returned by CookieSessionStore.Save if a session
+// does not fit into a cookie.
+var ErrSessionTooLarge = errors.New("session too large for cookie")
+
+// maxCookieSize is the maximum size in bytes of a cookie's name and value.
+// Browsers accept at least 4096 bytes, including attributes.
+const maxCookieSize = 4000
+
+// A CookieSessionStore stores sessions in an encrypted cookie on the client,
+// so no server-side storage is needed. Sessions must be small, since cookies
+// are limited to about 4KB, and are sent with each request.
+// Since it needs the request and response, it is not a SessionStore but is
+// used like a SessionManager: Find the session in the request, and Save it
+// in the response, or use Wrap.
+// Deleted sessions cannot be revoked on the server: a client that kept
+// an old cookie can use it until it expires.
+type CookieSessionStore struct {
+	cipher         *CookieCipher
+	CookieName     string
+	CookiePath     string
+	CookieDomain   string
+	CookieSameSite http.SameSite
+	CookieSecure   bool
+	CookieHttpOnly bool
+	TTL            time.Duration // cookie Max-Age, 0 means a browser session cookie
+}
+
+// NewCookieSessionStore creates a CookieSessionStore that encrypts sessions
+// with key, which must be 32 random bytes. Cookie attributes default
+// to the same values as in NewSessionManager.
+func NewCookieSessionStore(key []byte, cookieName string, ttl time.Duration) (*CookieSessionStore, error) {
+	cipher, err := NewCookieCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &CookieSessionStore{
+		cipher:         cipher,
+		CookieName:     cookieName,
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteLaxMode,
+		CookieHttpOnly: true,
+		TTL:            ttl,
+	}, nil
+}
+
+// cookieSession is the JSON format of a session in a CookieSessionStore.
+type cookieSession struct {
+	Id string `json:"id"`
+	fileSession
+}
+
+// Find returns the session from the request's session cookie, or a zero Session
+// if there is no cookie, or the cookie is invalid or expired.
+func (st *CookieSessionStore) Find(req Request) Session {
+	value := req.CookieValue(st.CookieName, "")
+	if value == "" {
+		return Session{}
+	}
+	data, err := st.cipher.Decrypt(st.CookieName, value)
+	if err != nil {
+		return Session{}
+	}
+	var cs cookieSession
+	if json.Unmarshal([]byte(data), &cs) != nil || cs.Id == "" {
+		return Session{}
+	}
+	session := cs.session(cs.Id)
+	if session.IsExpired() {
+		return Session{}
+	}
+	return session
+}
+
+// Save sets the session cookie on the response. It returns ErrSessionTooLarge
+// if the encrypted session is larger than about 4KB.
+func (st *CookieSessionStore) Save(res Response, session Session) (Response, error) {
+	data, err := json.Marshal(cookieSession{session.id, newFileSession(session)})
+	if err != nil {
+		return res, err
+	}
+	value := st.cipher.Encrypt(st.CookieName, string(data))
+	if size := len(st.CookieName) + len(value); size > maxCookieSize {
+		return res, fmt.Errorf("cannot save session: %w: %d bytes, max. %d", ErrSessionTooLarge, size, maxCookieSize)
+	}
+	return res.WithCookieOpts(st.CookieName, value, st.TTL, st.cookieOptions()), nil
+}
+
+// Delete clears the session cookie on the response.
+func (st *CookieSessionStore) Delete(res Response) Response {
+	return res.WithCookieOpts(st.CookieName, "", -1, st.cookieOptions())
+}
+
+// Wrap returns a handler that finds the request's session and passes a pointer
+// to it to handler, see SessionManager.Wrap.
+func (st *CookieSessionStore) Wrap(handler func(req Request, session *Session) Response) func(Request) Response {
+	return sessionWrapper{
+		find: st.Find,
+		create: func() (Session, error) {
+			return NewSession(), nil
+		},
+		save: func(req Request, res Response, original, session Session) (Response, error) {
+			if session.IsZero() {
+				return st.Delete(res), nil
+			}
+			return st.Save(res, session)
+		},
+	}.wrap(handler)
+}
+
+func (st *CookieSessionStore) cookieOptions() CookieOptions {
+	return CookieOptions{
+		Path:     st.CookiePath,
+		Domain:   st.CookieDomain,
+		Secure:   st.CookieSecure,
+		HttpOnly: st.CookieHttpOnly,
+		SameSite: st.CookieSameSite,
+	}
+}
+
+// SessionStore stores session
+// Find returns a zero Session if the session is not found or has expired.
+type SessionStore interface {
+	Save(session Session) error
+	Delete(id string) error
+	Find(id string) Session
+	// FindAll returns all sessions sorted by id, or an empty, non-nil slice if there are none.
+	FindAll() []Session
+}
+
+// SessionCleaner is an optional interface implemented by SessionStores that
+// can delete expired sessions in the background.
+type SessionCleaner interface {
+	// StartCleanup starts a goroutine that deletes expired sessions every interval.
+	// If cleanup is already running, it is restarted with the new interval.
+	StartCleanup(interval time.Duration)
+	// StopCleanup stops the cleanup goroutine and waits until it has exited.
+	// It does nothing if cleanup is not running.
+	StopCleanup()
+}
+
+// sessionCleanup runs a cleanup func periodically in a goroutine.
+type sessionCleanup struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (c *sessionCleanup) start(interval time.Duration, cleanup func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.stop = stop
+	c.done = done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cleanup()
+			}
+		}
+	}()
+}
+
+func (c *sessionCleanup) stopAndWait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked()
+}
+
+func (c *sessionCleanup) stopLocked() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+	c.done = nil
+}
+
+// deleteExpired deletes all expired sessions from a map and returns true if one was deleted.
+func deleteExpired(sessions map[string]Session) bool {
+	deleted := false
+	for id, session := range sessions {
+		if session.IsExpired() {
+			delete(sessions, id)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// SessionPager is an optional interface implemented by SessionStores that can
+// load sessions page by page, e.g. for paginated admin pages.
+type SessionPager interface {
+	// FindPage returns at most limit sessions, sorted by id, skipping the first offset sessions.
+	// It returns an empty slice if offset is past the end.
+	FindPage(offset, limit int) ([]Session, error)
+}
+
+// SessionCounter is an optional interface implemented by SessionStores that can
+// count their sessions without loading them.
+type SessionCounter interface {
+	// Count returns the number of sessions, like len(FindAll()).
+	Count() int
+}
+
+// findPage returns a page of sessions, sorted by id.
+func findPage(sessions map[string]Session, offset, limit int) []Session {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if limit < len(ids) {
+		ids = ids[:limit]
 	}
-	sort.Strings(keys)
-	return keys
-}
-
-// SessionStore stores session
-type SessionStore interface {
-	Save(session Session) error
-	Delete(id string) error
-	Find(id string) Session
-	FindAll() []Session
+	page := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		page = append(page, sessions[id].clone())
+	}
+	return page
 }
 
 // FileSessionStore stores sessions in a json file.
@@ -447,9 +3853,13 @@ type FileSessionStore struct {
 	filename string
 	mu       sync.Mutex
 	sessions map[string]Session
+	cleanup  sessionCleanup
 }
 
 var _ SessionStore = (*FileSessionStore)(nil)
+var _ SessionPager = (*FileSessionStore)(nil)
+var _ SessionCounter = (*FileSessionStore)(nil)
+var _ SessionCleaner = (*FileSessionStore)(nil)
 
 func NewFileSessionStore(filename string) (SessionStore, error) {
 	store := &FileSessionStore{
@@ -463,29 +3873,86 @@ func NewFileSessionStore(filename string) (SessionStore, error) {
 		}
 		return store, err
 	}
-	var valuesMap map[string]map[string]string
-	err = json.Unmarshal(data, &valuesMap)
+	var jsessions map[string]json.RawMessage
+	err = json.Unmarshal(data, &jsessions)
 	if err != nil {
 		return store, err
 	}
 	sessions := make(map[string]Session)
-	for id, values := range valuesMap {
-		sessions[id] = Session{
-			id:     id,
-			values: values,
+	for id, jdata := range jsessions {
+		session, err := unmarshalFileSession(id, jdata)
+		if err != nil {
+			return store, err
 		}
+		sessions[id] = session
 	}
 	store.sessions = sessions
 	return store, nil
 }
 
+// fileSession is the JSON format of a session in a FileSessionStore.
+type fileSession struct {
+	Values   map[string]string `json:"values"`
+	Created  int64             `json:"created,omitempty"`  // unix millis
+	Expires  int64             `json:"expires,omitempty"`  // unix millis
+	Accessed int64             `json:"accessed,omitempty"` // unix millis
+}
+
+// newFileSession converts a session to its JSON format.
+func newFileSession(s Session) fileSession {
+	fs := fileSession{Values: s.values}
+	if fs.Values == nil {
+		fs.Values = make(map[string]string) // must not be null, see unmarshalFileSession
+	}
+	if !s.created.IsZero() {
+		fs.Created = s.created.UnixMilli()
+	}
+	if !s.expires.IsZero() {
+		fs.Expires = s.expires.UnixMilli()
+	}
+	if !s.accessed.IsZero() {
+		fs.Accessed = s.accessed.UnixMilli()
+	}
+	return fs
+}
+
+// session converts the JSON format to a session.
+func (fs fileSession) session(id string) Session {
+	session := Session{id: id, values: fs.Values}
+	if fs.Created != 0 {
+		session.created = time.UnixMilli(fs.Created)
+	}
+	if fs.Expires != 0 {
+		session.expires = time.UnixMilli(fs.Expires)
+	}
+	if fs.Accessed != 0 {
+		session.accessed = time.UnixMilli(fs.Accessed)
+	}
+	return session
+}
+
+// unmarshalFileSession decodes a session. Older versions stored only the
+// values map, without timestamps, that format is still supported.
+func unmarshalFileSession(id string, data []byte) (Session, error) {
+	var values map[string]string
+	if json.Unmarshal(data, &values) == nil {
+		return Session{id: id, values: values}, nil
+	}
+	var fs fileSession
+	err := json.Unmarshal(data, &fs)
+	if err != nil {
+		return Session{}, err
+	}
+	return fs.session(id), nil
+}
+
 func (st *FileSessionStore) Save(session Session) error {
 	if session.IsZero() {
 		return nil
 	}
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	st.sessions[session.id] = session
+	st.sessions[session.id] = session.clone()
 	return st.save()
 }
 
@@ -503,15 +3970,19 @@ func (st *FileSessionStore) Delete(id string) error {
 func (st *FileSessionStore) Find(id string) Session {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	return st.sessions[id]
+	session := st.sessions[id]
+	if session.IsExpired() {
+		return Session{}
+	}
+	return session.clone()
 }
 
 func (st *FileSessionStore) FindAll() []Session {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	var tmp []Session
+	tmp := make([]Session, 0, len(st.sessions))
 	for _, session := range st.sessions {
-		tmp = append(tmp, session)
+		tmp = append(tmp, session.clone())
 	}
 	sort.Slice(tmp, func(i, j int) bool {
 		a := tmp[i]
@@ -521,10 +3992,38 @@ func (st *FileSessionStore) FindAll() []Session {
 	return tmp
 }
 
+func (st *FileSessionStore) FindPage(offset, limit int) ([]Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return findPage(st.sessions, offset, limit), nil
+}
+
+func (st *FileSessionStore) Count() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+func (st *FileSessionStore) StartCleanup(interval time.Duration) {
+	st.cleanup.start(interval, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if deleteExpired(st.sessions) {
+			if err := st.save(); err != nil {
+				log.Printf("webs: cannot save sessions after cleanup: %s", err)
+			}
+		}
+	})
+}
+
+func (st *FileSessionStore) StopCleanup() {
+	st.cleanup.stopAndWait()
+}
+
 func (st *FileSessionStore) save() error {
-	jsessions := make(map[string]map[string]string)
+	jsessions := make(map[string]fileSession)
 	for id, s := range st.sessions {
-		jsessions[id] = s.values
+		jsessions[id] = newFileSession(s)
 	}
 	data, err := json.Marshal(jsessions)
 	if err != nil {
@@ -541,9 +4040,13 @@ func (st *FileSessionStore) save() error {
 type MemorySessionStore struct {
 	mu       sync.Mutex
 	sessions map[string]Session
+	cleanup  sessionCleanup
 }
 
 var _ SessionStore = (*MemorySessionStore)(nil)
+var _ SessionPager = (*MemorySessionStore)(nil)
+var _ SessionCounter = (*MemorySessionStore)(nil)
+var _ SessionCleaner = (*MemorySessionStore)(nil)
 
 func NewMemorySessionStore() SessionStore {
 	return &MemorySessionStore{
@@ -557,7 +4060,7 @@ func (st *MemorySessionStore) Save(session Session) error {
 	}
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	st.sessions[session.id] = session
+	st.sessions[session.id] = session.clone()
 	return nil
 }
 
@@ -571,15 +4074,19 @@ func (st *MemorySessionStore) Delete(id string) error {
 func (st *MemorySessionStore) Find(id string) Session {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	return st.sessions[id]
+	session := st.sessions[id]
+	if session.IsExpired() {
+		return Session{}
+	}
+	return session.clone()
 }
 
 func (st *MemorySessionStore) FindAll() []Session {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	var tmp []Session
+	tmp := make([]Session, 0, len(st.sessions))
 	for _, session := range st.sessions {
-		tmp = append(tmp, session)
+		tmp = append(tmp, session.clone())
 	}
 	sort.Slice(tmp, func(i, j int) bool {
 		a := tmp[i]
@@ -588,3 +4095,647 @@ func (st *MemorySessionStore) FindAll() []Session {
 	})
 	return tmp
 }
+
+func (st *MemorySessionStore) FindPage(offset, limit int) ([]Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return findPage(st.sessions, offset, limit), nil
+}
+
+func (st *MemorySessionStore) Count() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+func (st *MemorySessionStore) StartCleanup(interval time.Duration) {
+	st.cleanup.start(interval, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		deleteExpired(st.sessions)
+	})
+}
+
+func (st *MemorySessionStore) StopCleanup() {
+	st.cleanup.stopAndWait()
+}
+
+// A RedisClient is the subset of Redis commands used by RedisSessionStore.
+// Since webs does not depend on a Redis library, apps implement it with a few lines
+// on top of their Redis client library.
+type RedisClient interface {
+	// Get returns the value of key (GET), or false if not found.
+	Get(key string) (string, bool, error)
+	// Set sets the value of key (SET), with an expiry time (EX/PX) if ttl > 0.
+	Set(key, value string, ttl time.Duration) error
+	// Del deletes key (DEL). It is not an error if key does not exist.
+	Del(key string) error
+	// Keys returns all keys that start with prefix, e.g. with SCAN MATCH prefix*.
+	Keys(prefix string) ([]string, error)
+}
+
+// RedisSessionStore stores sessions in Redis, one key per session, with
+// the session's expiry time as Redis expiry. Sessions are encoded as JSON
+// in the same format as in a FileSessionStore.
+type RedisSessionStore struct {
+	client RedisClient
+	prefix string
+}
+
+var _ SessionStore = (*RedisSessionStore)(nil)
+
+// NewRedisSessionStore creates a RedisSessionStore that stores each session
+// under key prefix+id, e.g. with prefix "session:".
+func NewRedisSessionStore(client RedisClient, prefix string) *RedisSessionStore {
+	return &RedisSessionStore{client, prefix}
+}
+
+func (st *RedisSessionStore) Save(session Session) error {
+	if session.IsZero() {
+		return nil
+	}
+	var ttl time.Duration
+	if !session.expires.IsZero() {
+		ttl = time.Until(session.expires)
+		if ttl <= 0 {
+			return st.Delete(session.id)
+		}
+	}
+	data, err := json.Marshal(newFileSession(session))
+	if err != nil {
+		return err
+	}
+	return st.client.Set(st.prefix+session.id, string(data), ttl)
+}
+
+func (st *RedisSessionStore) Delete(id string) error {
+	return st.client.Del(st.prefix + id)
+}
+
+// Find returns the session for id. Redis errors are logged and
+// a zero Session is returned.
+func (st *RedisSessionStore) Find(id string) Session {
+	session, err := st.find(id)
+	if err != nil {
+		log.Printf("webs: cannot find session: %s", err)
+		return Session{}
+	}
+	return session
+}
+
+func (st *RedisSessionStore) find(id string) (Session, error) {
+	data, found, err := st.client.Get(st.prefix + id)
+	if err != nil || !found {
+		return Session{}, err
+	}
+	session, err := unmarshalFileSession(id, []byte(data))
+	if err != nil {
+		return Session{}, err
+	}
+	if session.IsExpired() {
+		return Session{}, nil
+	}
+	return session, nil
+}
+
+// FindAll returns all sessions, sorted by id. It reads all session keys
+// and should not be used for large numbers of sessions.
+// Redis errors are logged and the sessions found so far are returned.
+func (st *RedisSessionStore) FindAll() []Session {
+	all := make([]Session, 0)
+	keys, err := st.client.Keys(st.prefix)
+	if err != nil {
+		log.Printf("webs: cannot find sessions: %s", err)
+		return all
+	}
+	for _, key := range keys {
+		session, err := st.find(strings.TrimPrefix(key, st.prefix))
+		if err != nil {
+			log.Printf("webs: cannot find sessions: %s", err)
+			break
+		}
+		if !session.IsZero() {
+			all = append(all, session)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].id < all[j].id
+	})
+	return all
+}
+
+// ShardedSessionStore distributes sessions across several SessionStores,
+// e.g. several FileSessionStores for better write throughput.
+// Each session id is routed to one store by a shard func.
+type ShardedSessionStore struct {
+	stores []SessionStore
+	shard  func(id string, n int) int
+}
+
+var _ SessionStore = (*ShardedSessionStore)(nil)
+var _ SessionPager = (*ShardedSessionStore)(nil)
+var _ SessionCounter = (*ShardedSessionStore)(nil)
+
+// NewShardedSessionStore creates a ShardedSessionStore. The shard func returns
+// the index of the store for a session id, in the range [0,n). It must always return
+// the same index for the same id. If shard is nil, a FNV-1a hash of the id is used.
+func NewShardedSessionStore(stores []SessionStore, shard func(id string, n int) int) *ShardedSessionStore {
+	if len(stores) == 0 {
+		panic("no stores")
+	}
+	if shard == nil {
+		shard = HashShard
+	}
+	return &ShardedSessionStore{stores, shard}
+}
+
+// HashShard is the default shard func of ShardedSessionStore.
+func HashShard(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (st *ShardedSessionStore) store(id string) SessionStore {
+	return st.stores[st.shard(id, len(st.stores))]
+}
+
+func (st *ShardedSessionStore) Save(session Session) error {
+	if session.IsZero() {
+		return nil
+	}
+	return st.store(session.id).Save(session)
+}
+
+func (st *ShardedSessionStore) Delete(id string) error {
+	return st.store(id).Delete(id)
+}
+
+func (st *ShardedSessionStore) Find(id string) Session {
+	return st.store(id).Find(id)
+}
+
+// FindAll returns the sessions of all stores, sorted by id.
+func (st *ShardedSessionStore) FindAll() []Session {
+	all := make([]Session, 0)
+	for _, store := range st.stores {
+		all = append(all, store.FindAll()...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].id < all[j].id
+	})
+	return all
+}
+
+// FindPage returns a page of the sessions of all stores, sorted by id.
+// It loads the first offset+limit sessions of each store, using FindPage
+// for stores that implement SessionPager, and merges them.
+func (st *ShardedSessionStore) FindPage(offset, limit int) ([]Session, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	pages := make([][]Session, len(st.stores))
+	for i, store := range st.stores {
+		if pager, ok := store.(SessionPager); ok {
+			page, err := pager.FindPage(0, offset+limit)
+			if err != nil {
+				return nil, err
+			}
+			pages[i] = page
+		} else {
+			pages[i] = store.FindAll()
+		}
+	}
+	// merge the sorted pages, skipping the first offset sessions
+	page := make([]Session, 0, limit)
+	for n := 0; len(page) < limit; n++ {
+		next := -1
+		for i := range pages {
+			if len(pages[i]) > 0 && (next < 0 || pages[i][0].id < pages[next][0].id) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if n >= offset {
+			page = append(page, pages[next][0])
+		}
+		pages[next] = pages[next][1:]
+	}
+	return page, nil
+}
+
+// Count returns the number of sessions in all stores, using Count
+// for stores that implement SessionCounter.
+func (st *ShardedSessionStore) Count() int {
+	n := 0
+	for _, store := range st.stores {
+		if counter, ok := store.(SessionCounter); ok {
+			n += counter.Count()
+		} else {
+			n += len(store.FindAll())
+		}
+	}
+	return n
+}
+
+// GenerateToken returns a URL-safe, crypto-random token made of n random bytes.
+// It panics if the system's secure random number generator fails.
+func GenerateToken(n int) string {
+	buf := make([]byte, n)
+	_, err := crand.Read(buf)
+	if err != nil {
+		panic(fmt.Sprintf("cannot generate token: %s", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ErrInvalidToken is returned by ParseSignedToken if a token is malformed or
+// its signature does not match.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrExpiredToken is returned by ParseSignedToken if a token has expired.
+var ErrExpiredToken = errors.New("expired token")
+
+// signedToken is the JSON encoded content of a signed token.
+type signedToken struct {
+	Payload map[string]string `json:"p"`
+	Expires int64             `json:"e"` // unix seconds
+}
+
+// MakeSignedToken creates a token that carries a payload and expires after ttl.
+// The token is signed with HMAC-SHA256, so it cannot be forged without
+// knowing the secret. The payload is not encrypted, do not put secrets into it.
+// The token is URL-safe and can be used in links, e.g. for password-reset
+// or email-verification.
+func MakeSignedToken(payload map[string]string, ttl time.Duration, secret []byte) string {
+	data, _ := json.Marshal(signedToken{payload, time.Now().Add(ttl).Unix()}) // cannot fail for map[string]string
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(signToken(body, secret))
+}
+
+// ParseSignedToken validates a token created by MakeSignedToken and returns its payload.
+// It returns ErrInvalidToken if the token was tampered with and
+// ErrExpiredToken if the token has expired.
+func ParseSignedToken(token string, secret []byte) (map[string]string, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	sigData, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(sigData, signToken(body, secret)) {
+		return nil, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var t signedToken
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !time.Now().Before(time.Unix(t.Expires, 0)) {
+		return nil, ErrExpiredToken
+	}
+	return t.Payload, nil
+}
+
+func signToken(body string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// A CookieSigner signs cookie values with HMAC-SHA256, so that clients
+// can read but not modify them, e.g. for "remember me" cookies or preferences.
+// Signed values do not expire, use Response.WithCookie for that, or
+// MakeSignedToken for values that must expire on the server side.
+type CookieSigner struct {
+	secret []byte
+}
+
+// NewCookieSigner creates a CookieSigner. The secret should be at least 32 random bytes.
+func NewCookieSigner(secret []byte) *CookieSigner {
+	if len(secret) == 0 {
+		panic("no secret")
+	}
+	return &CookieSigner{secret}
+}
+
+// SignValue returns "value.signature". The signature covers the cookie
+// name, so a signed value cannot be moved to another cookie.
+// Value must be a valid cookie value, i.e. it must not contain spaces,
+// commas, semicolons, quotes or backslashes.
+func (s *CookieSigner) SignValue(name, value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(s.sign(name, value))
+}
+
+// VerifyValue verifies a value created by SignValue and returns the original value.
+// It returns false if the value was tampered with.
+func (s *CookieSigner) VerifyValue(name, signedValue string) (string, bool) {
+	i := strings.LastIndex(signedValue, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signedValue[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(signedValue[i+1:])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sig, s.sign(name, value)) {
+		return "", false
+	}
+	return value, true
+}
+
+func (s *CookieSigner) sign(name, value string) []byte {
+	return signToken(name+"\x00"+value, s.secret)
+}
+
+// ErrInvalidCookie is returned by CookieCipher.Decrypt if a value is malformed,
+// was tampered with, or was encrypted with another key.
+var ErrInvalidCookie = errors.New("invalid cookie")
+
+// A CookieCipher encrypts cookie values with AES-GCM, so that clients
+// can neither read nor modify them.
+type CookieCipher struct {
+	aead cipher.AEAD
+}
+
+// NewCookieCipher creates a CookieCipher. The key must be 32 random bytes.
+func NewCookieCipher(key []byte) (*CookieCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cannot create cookie cipher: key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cookie cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cookie cipher: %w", err)
+	}
+	return &CookieCipher{aead}, nil
+}
+
+// Encrypt encrypts a value for the named cookie and returns it base64url encoded,
+// so it can be used with Response.WithCookie.
+// Each call uses a random nonce, so encrypting the same value twice gives different results.
+// The cookie name is authenticated, so an encrypted value cannot be moved to another cookie.
+func (c *CookieCipher) Encrypt(name, value string) string {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("cannot generate nonce: %s", err))
+	}
+	data := c.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decrypt decrypts a value created by Encrypt for the same cookie name.
+// It returns ErrInvalidCookie if the value was tampered with.
+func (c *CookieCipher) Decrypt(name, encrypted string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return "", ErrInvalidCookie
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+	return string(plaintext), nil
+}
+
+// A Clock tells the current time. Use a fake Clock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock that returns time.Now().
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// A Cache is a concurrency-safe in-memory cache with a maximum number of entries.
+// If the cache is full, the least recently used entry is evicted.
+// Entries can have a TTL after which they expire.
+type Cache[K comparable, V any] struct {
+	maxEntries int
+	clock      Clock
+	mu         sync.Mutex
+	lru        *list.List // of *cacheEntry[K, V], most recently used first
+	entries    map[K]*list.Element
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero means never
+}
+
+// NewCache creates a Cache that holds at most maxEntries entries.
+// The clock is used for TTL expiry, pass SystemClock if unsure.
+func NewCache[K comparable, V any](maxEntries int, clock Clock) *Cache[K, V] {
+	if maxEntries <= 0 {
+		panic("maxEntries must be > 0")
+	}
+	return &Cache[K, V]{
+		maxEntries: maxEntries,
+		clock:      clock,
+		lru:        list.New(),
+		entries:    make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value for key and true, or the zero value and false if
+// key is not found or has expired.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	entry := elem.Value.(*cacheEntry[K, V])
+	if !entry.expires.IsZero() && !c.clock.Now().Before(entry.expires) {
+		c.remove(elem)
+		var zero V
+		return zero, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// Set stores a value for key. A ttl <= 0 means the entry never expires.
+func (c *Cache[K, V]) Set(key K, value V, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.clock.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[K, V])
+		entry.value = value
+		entry.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry[K, V]{key, value, expires})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete removes the entry for key, if any.
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet removed.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[K, V]).key)
+}
+
+// A RateLimiter limits the rate of events per key, e.g. requests per client IP.
+// It uses a token bucket per key: a bucket holds up to limit tokens, each event
+// takes one token, and the bucket is refilled with limit tokens per interval.
+// Buckets that are full again are pruned once per interval, so that memory
+// does not grow with the number of keys seen.
+// A RateLimiter is safe for concurrent use.
+type RateLimiter struct {
+	limit     int
+	interval  time.Duration
+	clock     Clock
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that allows limit events per interval and key.
+func NewRateLimiter(limit int, interval time.Duration, clock Clock) *RateLimiter {
+	if limit <= 0 || interval <= 0 {
+		panic("limit and interval must be > 0")
+	}
+	return &RateLimiter{
+		limit:    limit,
+		interval: interval,
+		clock:    clock,
+		buckets:  make(map[string]*rateBucket),
+	}
+}
+
+// Allow takes a token for key and returns true, or returns false if the
+// rate limit for key is exceeded.
+func (l *RateLimiter) Allow(key string) bool {
+	ok, _ := l.Take(key)
+	return ok
+}
+
+// Take takes a token for key and returns true, or returns false and the
+// time until the next token is available if the rate limit for key is exceeded.
+func (l *RateLimiter) Take(key string) (bool, time.Duration) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) >= l.interval {
+		l.prune(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &rateBucket{float64(l.limit), now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(l.limit) * float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > float64(l.limit) {
+		b.tokens = float64(l.limit)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(l.interval) / float64(l.limit))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Len returns the number of buckets, including full ones not yet pruned.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// prune removes buckets that have been refilled completely, since they
+// behave like new buckets.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.interval {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// RateLimited wraps a handler with a rate limit. Requests are counted per route
+// and per key, where key is usually the client IP, see Request.RemoteIP, so that a limiter can be
+// shared by several routes without them affecting each other. Use different
+// limiters for routes that need different limits, e.g. a strict one for login.
+// If the limit is exceeded, the handler is not called and status 429 is returned,
+// with a Retry-After header.
+func RateLimited(limiter *RateLimiter, route string, key func(Request) string, handler func(Request) Response) func(Request) Response {
+	return func(req Request) Response {
+		if ok, retryAfter := limiter.Take(route + "\x00" + key(req)); !ok {
+			return newTooManyRequestsResponse(retryAfter)
+		}
+		return handler(req)
+	}
+}
+
+// RateLimitMiddleware returns a Middleware that limits requests per key,
+// e.g. Request.RemoteIP, for all routes of a Router together.
+// If the limit is exceeded, status 429 is returned, with a Retry-After header.
+func RateLimitMiddleware(limiter *RateLimiter, key func(Request) string) Middleware {
+	return func(req Request, next func(Request) Response) Response {
+		if ok, retryAfter := limiter.Take(key(req)); !ok {
+			return newTooManyRequestsResponse(retryAfter)
+		}
+		return next(req)
+	}
+}
+
+// newTooManyRequestsResponse returns a status 429 response with a
+// Retry-After header in whole seconds, rounded up.
+func newTooManyRequestsResponse(retryAfter time.Duration) Response {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return NewStatusResponse(http.StatusTooManyRequests, "too many requests").WithHeader("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,29 @@
+package webs
+
+// Password hashing is kept out of webs.go, since it needs golang.org/x/crypto.
+// Copy this file only if you need HashPassword and CheckPassword.
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordCost is the bcrypt cost used by HashPassword.
+const passwordCost = 12
+
+// HashPassword hashes a password with a random salt for storage, using bcrypt
+// with a fixed cost. Use CheckPassword to verify a password against the hash.
+// Passwords longer than 72 bytes are rejected with an error.
+func HashPassword(plain string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plain), passwordCost)
+	if err != nil {
+		return "", fmt.Errorf("cannot hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CheckPassword returns true if plain matches a hash created by HashPassword.
+func CheckPassword(hash, plain string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)) == nil
+}
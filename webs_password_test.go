@@ -0,0 +1,21 @@
+package webs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	assertEq(t, nil, err)
+	assertEq(t, true, strings.HasPrefix(hash, "$2a$12$"))
+	assertEq(t, true, CheckPassword(hash, "secret"))
+	assertEq(t, false, CheckPassword(hash, "wrong"))
+	assertEq(t, false, CheckPassword("garbage", "secret"))
+	other, err := HashPassword("secret")
+	assertEq(t, nil, err)
+	assertEq(t, true, hash != other) // salted
+	// too long
+	_, err = HashPassword(strings.Repeat("x", 73))
+	assertEq(t, true, err != nil)
+}
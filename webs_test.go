@@ -0,0 +1,3854 @@
+package webs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+)
+
+func TestSignedToken(t *testing.T) {
+	secret := []byte("secret")
+	// valid token
+	{
+		token := MakeSignedToken(map[string]string{"user": "joe"}, time.Hour, secret)
+		payload, err := ParseSignedToken(token, secret)
+		assertEq(t, nil, err)
+		assertEq(t, 1, len(payload))
+		assertEq(t, "joe", payload["user"])
+	}
+	// expired token
+	{
+		token := MakeSignedToken(map[string]string{"user": "joe"}, -time.Second, secret)
+		_, err := ParseSignedToken(token, secret)
+		assertEq(t, ErrExpiredToken, err)
+	}
+	// tampered token
+	{
+		token := MakeSignedToken(map[string]string{"user": "joe"}, time.Hour, secret)
+		other := MakeSignedToken(map[string]string{"user": "admin"}, time.Hour, secret)
+		body, _, _ := strings.Cut(other, ".")
+		_, sig, _ := strings.Cut(token, ".")
+		_, err := ParseSignedToken(body+"."+sig, secret)
+		assertEq(t, ErrInvalidToken, err)
+	}
+	// wrong secret
+	{
+		token := MakeSignedToken(map[string]string{"user": "joe"}, time.Hour, secret)
+		_, err := ParseSignedToken(token, []byte("other"))
+		assertEq(t, ErrInvalidToken, err)
+	}
+}
+
+func TestCookieSigner(t *testing.T) {
+	signer := NewCookieSigner([]byte("secret"))
+	signed := signer.SignValue("theme", "dark.v2")
+	assertEq(t, true, strings.HasPrefix(signed, "dark.v2."))
+	// valid
+	{
+		value, ok := signer.VerifyValue("theme", signed)
+		assertEq(t, true, ok)
+		assertEq(t, "dark.v2", value)
+	}
+	// empty value
+	{
+		value, ok := signer.VerifyValue("theme", signer.SignValue("theme", ""))
+		assertEq(t, true, ok)
+		assertEq(t, "", value)
+	}
+	// tampered value
+	{
+		value, ok := signer.VerifyValue("theme", "light"+strings.TrimPrefix(signed, "dark"))
+		assertEq(t, false, ok)
+		assertEq(t, "", value)
+	}
+	// other cookie name
+	{
+		_, ok := signer.VerifyValue("lang", signed)
+		assertEq(t, false, ok)
+	}
+	// other secret
+	{
+		_, ok := NewCookieSigner([]byte("other")).VerifyValue("theme", signed)
+		assertEq(t, false, ok)
+	}
+	// malformed
+	{
+		for _, s := range []string{"", "dark", "dark.", "dark.!!!"} {
+			_, ok := signer.VerifyValue("theme", s)
+			assertEq(t, false, ok)
+		}
+	}
+	// round trip through a cookie
+	{
+		w := httptest.NewRecorder()
+		renderer := NewResponseRenderer(NewNullTemplateLoader())
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewStringResponse("ok").WithCookie("theme", signed, time.Hour))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Cookie", w.Result().Cookies()[0].String())
+		value, ok := signer.VerifyValue("theme", NewRequest(r).CookieValue("theme", ""))
+		assertEq(t, true, ok)
+		assertEq(t, "dark.v2", value)
+	}
+}
+
+func TestCookieCipher(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	c, err := NewCookieCipher(key)
+	assertEq(t, nil, err)
+	// round trip
+	encrypted := c.Encrypt("account", "user 42; admin")
+	{
+		assertEq(t, false, strings.Contains(encrypted, "admin"))
+		value, err := c.Decrypt("account", encrypted)
+		assertEq(t, nil, err)
+		assertEq(t, "user 42; admin", value)
+	}
+	// random nonce
+	{
+		assertEq(t, true, encrypted != c.Encrypt("account", "user 42; admin"))
+	}
+	// empty value
+	{
+		value, err := c.Decrypt("account", c.Encrypt("account", ""))
+		assertEq(t, nil, err)
+		assertEq(t, "", value)
+	}
+	// tampered, other name, other key, malformed
+	{
+		data, _ := base64.RawURLEncoding.DecodeString(encrypted)
+		data[len(data)-1] ^= 1
+		_, err := c.Decrypt("account", base64.RawURLEncoding.EncodeToString(data))
+		assertEq(t, ErrInvalidCookie, err)
+		_, err = c.Decrypt("other", encrypted)
+		assertEq(t, ErrInvalidCookie, err)
+		c2, _ := NewCookieCipher(bytes.Repeat([]byte("x"), 32))
+		_, err = c2.Decrypt("account", encrypted)
+		assertEq(t, ErrInvalidCookie, err)
+		for _, s := range []string{"", "abc", "!!!"} {
+			_, err = c.Decrypt("account", s)
+			assertEq(t, ErrInvalidCookie, err)
+		}
+	}
+	// invalid key
+	{
+		_, err := NewCookieCipher([]byte("short"))
+		assertEq(t, true, err != nil)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	assertEq(t, nil, SetTrustedProxies("10.0.0.0/8", "fd00::/8"))
+	defer SetTrustedProxies()
+	remoteIP := func(remoteAddr string, headers ...string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return NewRequest(r).RemoteIP()
+	}
+	// direct client, forwarded headers are ignored
+	assertEq(t, "1.2.3.4", remoteIP("1.2.3.4:4711"))
+	assertEq(t, "1.2.3.4", remoteIP("1.2.3.4:4711", "X-Forwarded-For", "5.6.7.8", "X-Real-IP", "5.6.7.8"))
+	assertEq(t, "2001:db8::1", remoteIP("[2001:db8::1]:4711"))
+	// trusted proxy without headers
+	assertEq(t, "10.0.0.1", remoteIP("10.0.0.1:4711"))
+	// trusted proxy with X-Real-IP
+	assertEq(t, "5.6.7.8", remoteIP("10.0.0.1:4711", "X-Real-IP", "5.6.7.8"))
+	assertEq(t, "10.0.0.1", remoteIP("10.0.0.1:4711", "X-Real-IP", "garbage"))
+	// trusted proxy with X-Forwarded-For, rightmost untrusted entry wins
+	assertEq(t, "5.6.7.8", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "5.6.7.8"))
+	assertEq(t, "5.6.7.8", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "6.6.6.6, 5.6.7.8, 10.0.0.2"))
+	assertEq(t, "5.6.7.8", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "5.6.7.8,10.0.0.2"))
+	assertEq(t, "5.6.7.8", remoteIP("[fd00::1]:4711", "X-Forwarded-For", "5.6.7.8"))
+	// X-Forwarded-For takes precedence over X-Real-IP
+	assertEq(t, "5.6.7.8", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "5.6.7.8", "X-Real-IP", "6.6.6.6"))
+	// all entries trusted
+	assertEq(t, "10.0.0.3", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "10.0.0.3, 10.0.0.2"))
+	// invalid entry stops the search
+	assertEq(t, "10.0.0.2", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "5.6.7.8, garbage, 10.0.0.2"))
+	assertEq(t, "10.0.0.1", remoteIP("10.0.0.1:4711", "X-Forwarded-For", "garbage"))
+}
+
+func TestRedirectResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("POST", "/", nil), res)
+		return w
+	}
+	assertEq(t, 303, render(NewRedirectResponse("/a")).Code)
+	assertEq(t, "/a", render(NewRedirectResponse("/a")).Header().Get("Location"))
+	assertEq(t, 301, render(NewPermanentRedirectResponse("/b")).Code)
+	assertEq(t, "/b", render(NewPermanentRedirectResponse("/b")).Header().Get("Location"))
+	assertEq(t, 307, render(NewRedirectResponseWithStatus("/c", 307)).Code)
+	assertEq(t, 308, render(NewRedirectResponseWithStatus("/c", 308)).Code)
+	assertEq(t, 303, render(NewRedirectResponseWithStatus("/c", 200)).Code)
+	assertEq(t, 303, render(NewRedirectResponseWithStatus("/c", 404)).Code)
+	assertEq(t, 302, render(NewRedirectResponseWithStatus("/c", 302)).Code)
+	assertEq(t, 303, render(NewRedirectResponseWithStatus("/c", 300)).Code)
+	assertEq(t, 303, render(NewRedirectResponseWithStatus("/c", 304)).Code)
+	assertEq(t, 303, render(NewRedirectResponseWithStatus("/c", 305)).Code)
+	// htmx
+	{
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("HX-Request", "true")
+		assertEq(t, true, NewRequest(r).IsHtmx())
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewRedirectResponse("/a"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "/a", w.Header().Get("HX-Redirect"))
+		assertEq(t, "", w.Header().Get("Location"))
+		assertEq(t, false, NewRequest(httptest.NewRequest("POST", "/", nil)).IsHtmx())
+	}
+}
+
+func TestTestRequest(t *testing.T) {
+	var _ Request = NewTestRequest("GET", "/")
+	// defaults
+	{
+		req := NewTestRequest("GET", "/search?q=go")
+		assertEq(t, "GET", req.Method())
+		assertEq(t, true, req.IsGet())
+		assertEq(t, "go", req.Query("q"))
+		assertEq(t, "192.0.2.1", req.RemoteIP())
+		assertEq(t, "", req.Param("id"))
+		assertEq(t, "", req.PostForm("name"))
+		assertEq(t, 0, len(req.Cookies()))
+		assertEq(t, context.Background(), req.Context())
+	}
+	// builder
+	{
+		req := NewTestRequest("GET", "/user/42?q=go").
+			WithMethod("PUT").
+			WithQuery("page", "2").
+			WithQuery("q", "rust").
+			WithPostForm("name", "joe").
+			WithPostForm("tags", "a", "b").
+			WithHeader("HX-Request", "true").
+			WithCookie("SID", "abc").
+			WithCookie("lang", "de").
+			WithParam("id", "42").
+			WithParam("tab", "profile").
+			WithRemoteAddr("203.0.113.7:4711")
+		assertEq(t, "PUT", req.Method())
+		assertEq(t, true, req.IsPut())
+		assertEq(t, "go", req.Query("q"))
+		assertEq(t, 2, req.QueryInt("page", 0))
+		assertEq(t, "joe", req.PostForm("name"))
+		assertEq(t, "a,b", strings.Join(req.PostFormAll("tags"), ","))
+		assertEq(t, true, req.IsHtmx())
+		assertEq(t, "abc", req.CookieValue("SID", ""))
+		assertEq(t, "de", req.CookieValue("lang", ""))
+		assertEq(t, 2, len(req.Cookies()))
+		assertEq(t, "SID=abc", req.Cookies()[0].String())
+		assertEq(t, "lang=de", req.Cookies()[1].String())
+		assertEq(t, "42", req.Param("id"))
+		assertEq(t, "profile", req.Param("tab"))
+		assertEq(t, "203.0.113.7", req.RemoteIP())
+		assertEq(t, "PUT", req.HttpRequest().Method)
+	}
+	// body
+	{
+		var v struct{ Name string }
+		req := NewTestRequest("POST", "/").WithBody("application/json", `{"name":"joe"}`)
+		assertEq(t, nil, req.BindJSON(&v))
+		assertEq(t, "joe", v.Name)
+	}
+	// context
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := NewTestRequest("GET", "/").WithParam("id", "1").WithContext(ctx)
+		assertEq(t, context.Canceled, req.Context().Err())
+		assertEq(t, "1", req.Param("id"))
+	}
+	// with a handler and renderer
+	{
+		handler := func(req Request) Response {
+			return NewStringResponse("hello " + req.Param("name"))
+		}
+		req := NewTestRequest("GET", "/hello/joe").WithParam("name", "joe")
+		body, status, err := NewResponseRenderer(NewNullTemplateLoader()).RenderToString(handler(req))
+		assertEq(t, nil, err)
+		assertEq(t, 200, status)
+		assertEq(t, "hello joe", body)
+	}
+}
+
+func TestRecordedResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	// redirect and cookies
+	{
+		res := NewRedirectResponse("/home").WithCookie("SID", "1", time.Hour).WithCookie("SID", "2", time.Hour)
+		rec := renderer.Record(nil, res)
+		assertEq(t, nil, rec.AssertStatus(303))
+		assertEq(t, nil, rec.AssertRedirect("/home"))
+		assertEq(t, `expected redirect to "/other" but was to "/home"`, rec.AssertRedirect("/other").Error())
+		assertEq(t, "expected status 200 but was 303", rec.AssertStatus(200).Error())
+		assertEq(t, 2, len(rec.Cookies))
+		assertEq(t, "2", rec.Cookie("SID").Value)
+		assertEq(t, true, rec.Cookie("none") == nil)
+	}
+	// json
+	{
+		rec := renderer.Record(nil, NewJsonResponse(M{"id": 7}))
+		var v struct{ Id int }
+		assertEq(t, nil, rec.AssertJson(&v))
+		assertEq(t, 7, v.Id)
+		assertEq(t, `expected redirect to "/" but status was 200`, rec.AssertRedirect("/").Error())
+		assertEq(t, nil, rec.AssertBodyContains(`"id":7`))
+		assertEq(t, `expected body to contain "x" but was "{\"id\":7}"`, rec.AssertBodyContains("x").Error())
+	}
+	// text and request
+	{
+		req := NewTestRequest("GET", "/").WithHeader("Accept", "application/json")
+		rec := renderer.Record(req.HttpRequest(), NewNegotiatedResponse("index.html", M{"a": 1}))
+		assertEq(t, nil, rec.AssertStatus(200))
+		assertEq(t, `{"a":1}`, rec.Body)
+		rec = renderer.Record(nil, NewStringResponse("ok"))
+		var v any
+		assertEq(t, `expected json but content type was "text/plain; charset=utf-8"`, rec.AssertJson(&v).Error())
+	}
+}
+
+func TestBindQuery(t *testing.T) {
+	type search struct {
+		Query    string    `query:"q"`
+		Page     int       `query:"page"`
+		Size     uint8     `query:"size"`
+		Archived bool      `query:"archived"`
+		MinPrice float64   `query:"min_price"`
+		Since    time.Time `query:"since"`
+		Tags     []string  `query:"tag"`
+		Ids      []int     `query:"id"`
+		Sort     string    // untagged, ignored
+		internal string    `query:"internal"`
+	}
+	bind := func(target string) (search, error) {
+		s := search{Page: 1, Size: 20, Sort: "name"}
+		err := NewTestRequest("GET", target).BindQuery(&s)
+		return s, err
+	}
+	// defaults
+	{
+		s, err := bind("/search?page=&sort=date&internal=x")
+		assertEq(t, nil, err)
+		assertEq(t, "", s.Query)
+		assertEq(t, 1, s.Page)
+		assertEq(t, uint8(20), s.Size)
+		assertEq(t, false, s.Archived)
+		assertEq(t, true, s.Since.IsZero())
+		assertEq(t, 0, len(s.Tags))
+		assertEq(t, "name", s.Sort)
+		assertEq(t, "", s.internal)
+	}
+	// all types
+	{
+		s, err := bind("/search?q=go+web&page=3&size=50&archived=on&min_price=9.5&since=2024-03-01&tag=a&tag=b&id=1&id=2&id=3")
+		assertEq(t, nil, err)
+		assertEq(t, "go web", s.Query)
+		assertEq(t, 3, s.Page)
+		assertEq(t, uint8(50), s.Size)
+		assertEq(t, true, s.Archived)
+		assertEq(t, 9.5, s.MinPrice)
+		assertEq(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), s.Since)
+		assertEq(t, "a,b", strings.Join(s.Tags, ","))
+		assertEq(t, 3, len(s.Ids))
+		assertEq(t, 3, s.Ids[2])
+		s, err = bind("/search?since=2024-03-01T12:30")
+		assertEq(t, nil, err)
+		assertEq(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), s.Since)
+		s, err = bind("/search?since=2024-03-01T12:30:00%2B02:00")
+		assertEq(t, nil, err)
+		assertEq(t, time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC).Unix(), s.Since.Unix())
+	}
+	// errors
+	{
+		_, err := bind("/search?page=abc")
+		assertEq(t, `cannot bind query: field Page: invalid int "abc"`, err.Error())
+		_, err = bind("/search?size=300")
+		assertEq(t, `cannot bind query: field Size: invalid uint "300"`, err.Error())
+		_, err = bind("/search?archived=maybe")
+		assertEq(t, `cannot bind query: field Archived: invalid bool "maybe"`, err.Error())
+		_, err = bind("/search?min_price=cheap")
+		assertEq(t, `cannot bind query: field MinPrice: invalid float "cheap"`, err.Error())
+		_, err = bind("/search?since=yesterday")
+		assertEq(t, `cannot bind query: field Since: invalid time "yesterday"`, err.Error())
+		_, err = bind("/search?id=1&id=x")
+		assertEq(t, `cannot bind query: field Ids: invalid int "x"`, err.Error())
+		var unsupported struct {
+			M map[string]string `query:"m"`
+		}
+		err = NewTestRequest("GET", "/?m=1").BindQuery(&unsupported)
+		assertEq(t, `cannot bind query: field M: unsupported type map[string]string`, err.Error())
+		err = NewTestRequest("GET", "/").BindQuery(search{})
+		assertEq(t, `cannot bind query: webs.search is not a pointer to a struct`, err.Error())
+	}
+}
+
+func TestBindForm(t *testing.T) {
+	// urlencoded
+	{
+		var f addForm
+		req := NewTestRequest("POST", "/add").WithPostForm("value1", "13").WithPostForm("value2", "29").WithPostForm("tag", "a", "b")
+		assertEq(t, nil, req.BindForm(&f))
+		assertEq(t, 13, f.Value1)
+		assertEq(t, 29, f.Value2)
+		assertEq(t, "a,b", strings.Join(f.Tags, ","))
+		assertEq(t, true, f.Upload == nil)
+	}
+	// validation of required fields
+	{
+		var f addForm
+		req := NewTestRequest("POST", "/add").WithPostForm("value1", "13").WithPostForm("value2", "")
+		assertEq(t, "value2 is required", req.BindForm(&f).Error())
+		assertEq(t, 13, f.Value1)
+	}
+	// parse error
+	{
+		var f addForm
+		req := NewTestRequest("POST", "/add").WithPostForm("value1", "x")
+		assertEq(t, `cannot bind form: field Value1: invalid int "x"`, req.BindForm(&f).Error())
+	}
+	// query parameters are not bound
+	{
+		var f addForm
+		req := NewTestRequest("POST", "/add?value1=1&value2=2")
+		assertEq(t, "value1 is required", req.BindForm(&f).Error())
+	}
+	// multipart with files
+	{
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("value1", "1")
+		mw.WriteField("value2", "2")
+		for _, name := range []string{"a.txt", "b.txt"} {
+			fw, err := mw.CreateFormFile("upload", name)
+			assertEq(t, nil, err)
+			io.WriteString(fw, "content of "+name)
+		}
+		fw, err := mw.CreateFormFile("attachment", "c.txt")
+		assertEq(t, nil, err)
+		io.WriteString(fw, "c")
+		mw.Close()
+		var f addForm
+		req := NewTestRequest("POST", "/add").WithBody(mw.FormDataContentType(), body.String())
+		assertEq(t, nil, req.BindForm(&f))
+		assertEq(t, 1, f.Value1)
+		assertEq(t, 2, f.Value2)
+		assertEq(t, 2, len(f.Upload))
+		assertEq(t, "a.txt", f.Upload[0].Filename())
+		data, err := io.ReadAll(f.Upload[1])
+		assertEq(t, nil, err)
+		assertEq(t, "content of b.txt", string(data))
+		assertEq(t, "c.txt", f.Attachment.Filename())
+		assertEq(t, int64(1), f.Attachment.Size())
+		for _, ff := range f.Upload {
+			assertEq(t, nil, ff.Close())
+		}
+		assertEq(t, nil, f.Attachment.Close())
+	}
+	// too large
+	{
+		defer func(size int64) { MaxUploadSize = size }(MaxUploadSize)
+		MaxUploadSize = 10
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("value1", "1234567890")
+		mw.Close()
+		var f addForm
+		req := NewTestRequest("POST", "/add").WithBody(mw.FormDataContentType(), body.String())
+		assertEq(t, true, errors.Is(req.BindForm(&f), ErrBodyTooLarge))
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	assertEq(t, ctx, req.Context())
+	assertEq(t, nil, req.Context().Err())
+	cancel()
+	assertEq(t, context.Canceled, req.Context().Err())
+}
+
+func TestNoContentAndCreatedResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("POST", "/", nil), res)
+		return w
+	}
+	// no content
+	{
+		w := render(NewNoContentResponse())
+		assertEq(t, 204, w.Code)
+		assertEq(t, "", w.Body.String())
+		w = render(NewStatusResponse(204, "ignored"))
+		assertEq(t, 204, w.Code)
+		assertEq(t, "", w.Body.String())
+	}
+	// created
+	{
+		w := render(NewCreatedResponse("/users/42"))
+		assertEq(t, 201, w.Code)
+		assertEq(t, "/users/42", w.Header().Get("Location"))
+		assertEq(t, "", w.Body.String())
+	}
+}
+
+func TestJsonErrorResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	w := httptest.NewRecorder()
+	res := NewJsonErrorResponse(404, "user not found").WithHeader("X-Request-Id", "r1")
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+	assertEq(t, 404, w.Code)
+	assertEq(t, "application/json", w.Header().Get("Content-Type"))
+	assertEq(t, "r1", w.Header().Get("X-Request-Id"))
+	assertEq(t, `{"error":"user not found","code":404}`, w.Body.String())
+}
+
+func TestHtmlResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// html
+	{
+		w := render(NewHtmlResponse("<p>Hello</p>"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "<p>Hello</p>", w.Body.String())
+	}
+	// with header and cookie
+	{
+		w := render(NewHtmlResponse("<li>item</li>").WithHeader("HX-Trigger", "added").WithCookie("last", "item", time.Hour))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "added", w.Header().Get("HX-Trigger"))
+		assertEq(t, "last=item; Max-Age=3600", w.Header().Get("Set-Cookie"))
+		assertEq(t, "<li>item</li>", w.Body.String())
+	}
+}
+
+func TestNegotiatedResponse(t *testing.T) {
+	tpl := template.Must(template.New("user.html").Parse(`<p>{{.name}}</p>`))
+	renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+	render := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewNegotiatedResponse("user.html", M{"name": "joe"}))
+		return w
+	}
+	const html = "<p>joe</p>"
+	const json = `{"name":"joe"}`
+	for _, tc := range []struct {
+		accept string
+		body   string
+	}{
+		{"", html},
+		{"*/*", html},
+		{"text/html", html},
+		{"application/json", json},
+		{"application/json, text/html", html},
+		{"text/html, application/json;q=0.9", html},
+		{"text/html;q=0.5, application/json", json},
+		{"application/*", json},
+		{"application/*;q=0.8, */*;q=0.9", html},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", html},
+		{"application/json;q=0.1", json},
+		{"application/json;q=0", html},
+		{"garbage", html},
+	} {
+		w := render(tc.accept)
+		assertEq(t, 200, w.Code)
+		assertEq(t, tc.body, w.Body.String())
+		assertEq(t, "Accept", w.Header().Get("Vary"))
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// response
+	{
+		w := render(NewStringResponse("ok").WithSecurityHeaders(""))
+		assertEq(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assertEq(t, "DENY", w.Header().Get("X-Frame-Options"))
+		assertEq(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"))
+		assertEq(t, DefaultContentSecurityPolicy, w.Header().Get("Content-Security-Policy"))
+		w = render(NewStringResponse("ok").WithSecurityHeaders("default-src 'none'"))
+		assertEq(t, "default-src 'none'", w.Header().Get("Content-Security-Policy"))
+	}
+	// renderer
+	{
+		renderer.DefaultHeaders = SecurityHeaders("")
+		w := render(NewJsonResponse(1))
+		assertEq(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assertEq(t, DefaultContentSecurityPolicy, w.Header().Get("Content-Security-Policy"))
+		// headers of the response win
+		w = render(NewStringResponse("ok").WithHeader("X-Frame-Options", "SAMEORIGIN"))
+		assertEq(t, 1, len(w.Header().Values("X-Frame-Options")))
+		assertEq(t, "SAMEORIGIN", w.Header().Get("X-Frame-Options"))
+		// headers of a handler before the renderer win
+		handler := NewCspNonceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			renderer.Render(w, r, NewStringResponse("ok"))
+		}), "script-src 'nonce-{nonce}'")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assertEq(t, true, strings.HasPrefix(w.Header().Get("Content-Security-Policy"), "script-src 'nonce-"))
+		assertEq(t, "DENY", w.Header().Get("X-Frame-Options"))
+	}
+	// response with a nonce handler before the renderer
+	{
+		renderer.DefaultHeaders = nil
+		handler := NewCspNonceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			renderer.Render(w, r, NewStringResponse("ok").WithSecurityHeaders(""))
+		}), "script-src 'nonce-{nonce}'")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assertEq(t, 1, len(w.Header().Values("Content-Security-Policy")))
+		assertEq(t, true, strings.HasPrefix(w.Header().Get("Content-Security-Policy"), "script-src 'nonce-"))
+		assertEq(t, "DENY", w.Header().Get("X-Frame-Options"))
+	}
+}
+
+func TestWithContentType(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// content response
+	{
+		res := NewContentResponse([]byte("png"), "", "")
+		res2 := res.WithContentType("image/png").WithContentDisposition("inline")
+		assertEq(t, "", res.ContentType)
+		assertEq(t, "image/png", res2.ContentType)
+		assertEq(t, "inline", res2.ContentDisposition)
+		w := render(res2)
+		assertEq(t, "image/png", w.Header().Get("Content-Type"))
+		assertEq(t, "inline", w.Header().Get("Content-Disposition"))
+	}
+	// file response
+	{
+		res := NewFileResponse("webs.go", "", "").WithContentType("text/x-go").WithContentDisposition("attachment")
+		assertEq(t, "text/x-go", res.FileType)
+		assertEq(t, "attachment", res.FileDisposition)
+		w := render(res)
+		assertEq(t, "text/x-go", w.Header().Get("Content-Type"))
+		assertEq(t, "attachment", w.Header().Get("Content-Disposition"))
+	}
+	// stream response
+	{
+		res := NewStreamResponse(strings.NewReader("a,b"), "").WithContentType("text/csv")
+		assertEq(t, "text/csv", res.ContentType)
+		assertEq(t, "text/csv", render(res).Header().Get("Content-Type"))
+	}
+	// json response
+	{
+		res := NewJsonResponse(1).WithContentType("application/problem+json").WithContentDisposition("inline")
+		w := render(res)
+		assertEq(t, "application/problem+json", w.Header().Get("Content-Type"))
+		assertEq(t, "inline", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestDownloadResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	download := func(filename string) string {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewDownloadResponse([]byte("a,b"), filename, "text/csv"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/csv", w.Header().Get("Content-Type"))
+		assertEq(t, "a,b", w.Body.String())
+		return w.Header().Get("Content-Disposition")
+	}
+	assertEq(t, "attachment; filename=report.csv", download("report.csv"))
+	assertEq(t, `attachment; filename="my report.csv"`, download("my report.csv"))
+	assertEq(t, `attachment; filename="say \"hi\".csv"`, download(`say "hi".csv`))
+	assertEq(t, `attachment; filename="Gr__e 2023.csv"; filename*=UTF-8''Gr%C3%BC%C3%9Fe%202023.csv`, download("Grüße 2023.csv"))
+	assertEq(t, `attachment; filename=_.txt; filename*=UTF-8''%E6%97%A5.txt`, download("日.txt"))
+	// the header can be parsed
+	_, params, err := mime.ParseMediaType(download("Grüße 2023.csv"))
+	assertEq(t, nil, err)
+	assertEq(t, "Grüße 2023.csv", params["filename"])
+}
+
+func TestCsvResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	var logbuf bytes.Buffer
+	log.SetOutput(&logbuf)
+	defer log.SetOutput(os.Stderr)
+	// rows
+	{
+		res := NewCsvResponse("report.csv", []string{"id", "name"}, func(write func([]string) error) error {
+			for i := 1; i <= 2500; i++ {
+				if err := write([]string{strconv.Itoa(i), "joe, \"jr\""}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "attachment; filename=report.csv", w.Header().Get("Content-Disposition"))
+		assertEq(t, true, w.Flushed)
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		assertEq(t, 2501, len(lines))
+		assertEq(t, "id,name", lines[0])
+		assertEq(t, `2500,"joe, ""jr"""`, lines[2500])
+	}
+	// error in rows
+	{
+		res := NewCsvResponse("report.csv", nil, func(write func([]string) error) error {
+			write([]string{"1"})
+			return errors.New("db failed")
+		})
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		assertEq(t, 200, w.Code)
+		assertEq(t, true, strings.Contains(logbuf.String(), "cannot write csv: db failed"))
+	}
+	// write error stops rows
+	{
+		count := 0
+		res := NewCsvResponse("report.csv", nil, func(write func([]string) error) error {
+			for {
+				if err := write([]string{"row"}); err != nil {
+					return err
+				}
+				count++
+			}
+		})
+		renderer.Render(&failingResponseWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil), res)
+		assertEq(t, true, count < 2*csvFlushRows)
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	supported := []string{"en", "de", "de-CH", "fr"}
+	for _, tc := range []struct {
+		header string
+		exp    string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"DE", "de"},
+		{"de-CH", "de-CH"},
+		{"de-AT", "de"},
+		{"fr-FR, en;q=0.5", "fr"},
+		{"en;q=0.5, fr;q=0.8", "fr"},
+		{"it, de;q=0.3", "de"},
+		{"it", "en"},
+		{"*", "en"},
+		{"it, *;q=0.1", "en"},
+		{"en;q=0, *", "de"},
+		{"fr;q=abc, de;q=0.5", "de"},
+		{"fr;q=2, de;q=0.5", "de"},
+		{"fr;x=1, de;q=0.5", "de"},
+		{",,;q=1, de", "de"},
+		{"de-ch;q=0.9, de;q=0.9", "de"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", tc.header)
+		assertEq(t, tc.exp, NewRequest(r).PreferredLanguage(supported))
+	}
+	assertEq(t, "", NewRequest(httptest.NewRequest("GET", "/", nil)).PreferredLanguage(nil))
+}
+
+func TestBasicAuth(t *testing.T) {
+	newRequest := func(authorization string) Request {
+		r := httptest.NewRequest("GET", "/admin", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return NewRequest(r)
+	}
+	// valid
+	{
+		r := httptest.NewRequest("GET", "/admin", nil)
+		r.SetBasicAuth("joe", "s3cret:x")
+		username, password, ok := NewRequest(r).BasicAuth()
+		assertEq(t, true, ok)
+		assertEq(t, "joe", username)
+		assertEq(t, "s3cret:x", password)
+	}
+	// invalid
+	for _, authorization := range []string{"", "Bearer abc", "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("nocolon"))} {
+		_, _, ok := newRequest(authorization).BasicAuth()
+		assertEq(t, false, ok)
+	}
+	// challenge
+	{
+		w := httptest.NewRecorder()
+		NewResponseRenderer(NewNullTemplateLoader()).Render(w, httptest.NewRequest("GET", "/", nil), NewBasicAuthChallengeResponse(`Admin "area"`))
+		assertEq(t, 401, w.Code)
+		assertEq(t, `Basic realm="Admin \"area\"", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	bearer := func(authorization string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return NewRequest(r).BearerToken()
+	}
+	// missing header
+	assertEq(t, "", bearer(""))
+	// wrong scheme
+	assertEq(t, "", bearer("Basic am9lOnB3"))
+	assertEq(t, "", bearer("Bearerabc"))
+	// malformed
+	assertEq(t, "", bearer("Bearer "))
+	assertEq(t, "", bearer("Bearer a b"))
+	// valid
+	assertEq(t, "abc.def-ghi", bearer("Bearer abc.def-ghi"))
+	assertEq(t, "abc", bearer("bearer abc"))
+	assertEq(t, "abc", bearer("BEARER  abc "))
+}
+
+func TestFindPage(t *testing.T) {
+	fileStore, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	assertEq(t, nil, err)
+	for _, store := range []SessionStore{NewMemorySessionStore(), fileStore} {
+		for _, id := range []string{"c", "a", "e", "b", "d"} {
+			assertEq(t, nil, store.Save(Session{id: id}))
+		}
+		pager := store.(SessionPager)
+		page := func(offset, limit int) string {
+			sessions, err := pager.FindPage(offset, limit)
+			assertEq(t, nil, err)
+			var ids []string
+			for _, s := range sessions {
+				ids = append(ids, s.Id())
+			}
+			return strings.Join(ids, ",")
+		}
+		assertEq(t, "a,b", page(0, 2))
+		assertEq(t, "c,d", page(2, 2))
+		assertEq(t, "e", page(4, 2))
+		assertEq(t, "", page(5, 2))
+		assertEq(t, "", page(10, 2))
+		assertEq(t, "a,b,c,d,e", page(0, 100))
+		assertEq(t, "", page(0, 0))
+		assertEq(t, "a", page(-1, 1))
+	}
+}
+
+func TestHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("Content-Type", "text/plain")
+	r.Header.Add("X-Multi", "one")
+	r.Header.Add("X-Multi", "two")
+	r.Header["X-Empty"] = []string{""}
+	req := NewRequest(r)
+	// mixed-case lookups
+	assertEq(t, "text/plain", req.Header("Content-Type"))
+	assertEq(t, "text/plain", req.Header("content-type"))
+	assertEq(t, "text/plain", req.Header("CONTENT-TYPE"))
+	assertEq(t, 2, len(req.HeaderValues("x-multi")))
+	assertEq(t, "one", req.HeaderValues("x-multi")[0])
+	assertEq(t, "two", req.HeaderValues("X-MULTI")[1])
+	assertEq(t, "one", req.Header("x-multi"))
+	// empty-valued header is present
+	assertEq(t, "", req.Header("x-empty"))
+	assertEq(t, true, req.HasHeader("x-empty"))
+	// absent header
+	assertEq(t, "", req.Header("x-absent"))
+	assertEq(t, 0, len(req.HeaderValues("x-absent")))
+	assertEq(t, false, req.HasHeader("x-absent"))
+}
+
+func TestQueryIntBool(t *testing.T) {
+	req := NewRequest(httptest.NewRequest("GET", "/?page=3&bad=x&a=1&b=TRUE&c=On&d=yes&e=no&f=maybe", nil))
+	assertEq(t, 3, req.QueryInt("page", 1))
+	assertEq(t, 1, req.QueryInt("bad", 1))
+	assertEq(t, 1, req.QueryInt("missing", 1))
+	assertEq(t, true, req.QueryBool("a", false))
+	assertEq(t, true, req.QueryBool("b", false))
+	assertEq(t, true, req.QueryBool("c", false))
+	assertEq(t, true, req.QueryBool("d", false))
+	assertEq(t, false, req.QueryBool("e", true))
+	assertEq(t, true, req.QueryBool("f", true))
+	assertEq(t, false, req.QueryBool("missing", false))
+}
+
+func TestJsonHandler(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(f func(Request) (any, error)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, JsonHandler(f)(NewRequest(r)))
+		return w
+	}
+	// data
+	{
+		w := render(func(req Request) (any, error) {
+			return M{"name": "joe"}, nil
+		})
+		assertEq(t, 200, w.Code)
+		assertEq(t, `{"name":"joe"}`, w.Body.String())
+	}
+	// ApiError
+	{
+		w := render(func(req Request) (any, error) {
+			return nil, fmt.Errorf("cannot find user: %w", NewApiError(404, "user %d not found", 42))
+		})
+		assertEq(t, 404, w.Code)
+		assertEq(t, `{"error":"user 42 not found","code":404}`, w.Body.String())
+	}
+	// plain error
+	{
+		var logbuf bytes.Buffer
+		log.SetOutput(&logbuf)
+		defer log.SetOutput(os.Stderr)
+		w := render(func(req Request) (any, error) {
+			return nil, errors.New("db connection lost")
+		})
+		assertEq(t, 500, w.Code)
+		assertEq(t, `{"error":"internal server error","code":500}`, w.Body.String())
+		assertEq(t, true, strings.Contains(logbuf.String(), "db connection lost"))
+	}
+}
+
+func TestPostFormAll(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("color=red&color=blue&size=xl"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req := NewRequest(r)
+	colors := req.PostFormAll("color")
+	assertEq(t, 2, len(colors))
+	assertEq(t, "red", colors[0])
+	assertEq(t, "blue", colors[1])
+	assertEq(t, "red", req.PostForm("color"))
+	assertEq(t, 1, len(req.PostFormAll("size")))
+	missing := req.PostFormAll("missing")
+	assertEq(t, true, missing != nil)
+	assertEq(t, 0, len(missing))
+}
+
+func TestBindJSON(t *testing.T) {
+	newRequest := func(ctype, body string) Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", ctype)
+		return NewRequest(r)
+	}
+	type user struct {
+		Name string `json:"name"`
+	}
+	// valid json
+	{
+		var u user
+		err := newRequest("application/json; charset=utf-8", `{"name":"joe"}`).BindJSON(&u)
+		assertEq(t, nil, err)
+		assertEq(t, "joe", u.Name)
+	}
+	// trailing whitespace is ok
+	{
+		var u user
+		err := newRequest("application/json", "{\"name\":\"joe\"}\n  ").BindJSON(&u)
+		assertEq(t, nil, err)
+		assertEq(t, "joe", u.Name)
+	}
+	// trailing second object
+	{
+		var u user
+		err := newRequest("application/json", `{"name":"joe"}{"name":"bob"}`).BindJSON(&u)
+		assertEq(t, "cannot bind json: unexpected data after json value", err.Error())
+	}
+	// trailing garbage
+	{
+		var u user
+		err := newRequest("application/json", `{"name":"joe"} x`).BindJSON(&u)
+		assertEq(t, true, err != nil)
+	}
+	// malformed json
+	{
+		var u user
+		err := newRequest("application/json", `{"name":`).BindJSON(&u)
+		assertEq(t, true, err != nil)
+	}
+	// wrong content type
+	{
+		var u user
+		err := newRequest("text/plain", `{"name":"joe"}`).BindJSON(&u)
+		assertEq(t, `cannot bind json: wrong content type "text/plain"`, err.Error())
+	}
+	// body too large
+	{
+		defer func(size int64) { MaxJsonBodySize = size }(MaxJsonBodySize)
+		MaxJsonBodySize = 10
+		var u user
+		err := newRequest("application/json", `{"name":"joe"}`).BindJSON(&u)
+		assertEq(t, true, errors.Is(err, ErrBodyTooLarge))
+	}
+}
+
+func TestContentResponseNoSniff(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	upload := []byte("<html><script>alert(1)</script></html>")
+	fsys := fstest.MapFS{"uploads/42": {Data: upload}, "assets/site.css": {Data: []byte("body{}")}}
+	// empty type
+	for _, res := range []Response{
+		NewContentResponse(upload, "", ""),
+		NewStreamResponse(bytes.NewReader(upload), ""),
+		NewSeekableResponse(bytes.NewReader(upload), "42", time.Time{}, ""),
+		NewFileResponseFS(fsys, "uploads/42", "", ""),
+	} {
+		w := render(res)
+		assertEq(t, 200, w.Code)
+		assertEq(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		assertEq(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assertEq(t, string(upload), w.Body.String())
+	}
+	// explicit type
+	{
+		w := render(NewContentResponse(upload, "text/plain", ""))
+		assertEq(t, "text/plain", w.Header().Get("Content-Type"))
+		assertEq(t, "", w.Header().Get("X-Content-Type-Options"))
+		w = render(NewContentResponse(upload, "", "").WithHeader("Content-Type", "image/png"))
+		assertEq(t, "image/png", w.Header().Get("Content-Type"))
+		assertEq(t, "", w.Header().Get("X-Content-Type-Options"))
+		w = render(NewFileResponseFS(fsys, "uploads/42", "text/plain", ""))
+		assertEq(t, "text/plain", w.Header().Get("Content-Type"))
+		assertEq(t, "", w.Header().Get("X-Content-Type-Options"))
+	}
+	// type from file extension
+	{
+		w := render(NewFileResponseFS(fsys, "assets/site.css", "", ""))
+		assertEq(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "", w.Header().Get("X-Content-Type-Options"))
+		w = render(NewSeekableResponse(strings.NewReader("body{}"), "site.css", time.Time{}, ""))
+		assertEq(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestContentResponseRanges(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	// no range
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewContentResponse(data, "text/plain", ""))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assertEq(t, string(data), w.Body.String())
+	}
+	// single range
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=10-15")
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewContentResponse(data, "text/plain", ""))
+		assertEq(t, 206, w.Code)
+		assertEq(t, "abcdef", w.Body.String())
+	}
+	// multi range
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=0-9,20-29")
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewContentResponse(data, "text/plain", ""))
+		assertEq(t, 206, w.Code)
+		assertEq(t, "bytes", w.Header().Get("Accept-Ranges"))
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		assertEq(t, nil, err)
+		assertEq(t, "multipart/byteranges", mediaType)
+		mr := multipart.NewReader(w.Body, params["boundary"])
+		var parts []string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			assertEq(t, nil, err)
+			assertEq(t, "text/plain", part.Header.Get("Content-Type"))
+			partData, err := io.ReadAll(part)
+			assertEq(t, nil, err)
+			parts = append(parts, part.Header.Get("Content-Range")+" "+string(partData))
+		}
+		assertEq(t, 2, len(parts))
+		assertEq(t, "bytes 0-9/36 0123456789", parts[0])
+		assertEq(t, "bytes 20-29/36 klmnopqrst", parts[1])
+	}
+}
+
+func TestSeekableResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	modtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// range, content type from name
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=10-15")
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewSeekableResponse(bytes.NewReader(data), "clip.txt", modtime, ""))
+		assertEq(t, 206, w.Code)
+		assertEq(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "bytes 10-15/36", w.Header().Get("Content-Range"))
+		assertEq(t, modtime.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+		assertEq(t, "abcdef", w.Body.String())
+	}
+	// if-modified-since
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-Modified-Since", modtime.Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, NewSeekableResponse(bytes.NewReader(data), "", modtime, ""))
+		assertEq(t, 304, w.Code)
+		assertEq(t, "", w.Body.String())
+	}
+	// explicit content type and disposition, no name and modtime, reader is closed
+	{
+		reader := &fakeReadSeekCloser{ReadSeeker: bytes.NewReader(data)}
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewSeekableResponse(reader, "", time.Time{}, "audio/wav").WithContentDisposition("inline"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "audio/wav", w.Header().Get("Content-Type"))
+		assertEq(t, "inline", w.Header().Get("Content-Disposition"))
+		assertEq(t, "", w.Header().Get("Last-Modified"))
+		assertEq(t, string(data), w.Body.String())
+		assertEq(t, true, reader.closed)
+	}
+}
+
+func TestJsonpResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// valid callbacks
+	{
+		w := render(NewJsonpResponse("cb", M{"a": 1}))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "application/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assertEq(t, `/**/cb({"a":1});`, w.Body.String())
+		w = render(NewJsonpResponse("$widget.on_data2", []int{1, 2}))
+		assertEq(t, 200, w.Code)
+		assertEq(t, `/**/$widget.on_data2([1,2]);`, w.Body.String())
+	}
+	// invalid callbacks
+	for _, callback := range []string{"", "alert(1);cb", "cb<script>", "2cb", "a..b", "a.", "cb\n", "ä", strings.Repeat("a", 129)} {
+		w := render(NewJsonpResponse(callback, 1))
+		assertEq(t, 400, w.Code)
+		assertEq(t, "invalid jsonp callback\n", w.Body.String())
+	}
+	// marshal error
+	{
+		w := render(NewJsonpResponse("cb", func() {}))
+		assertEq(t, 500, w.Code)
+	}
+}
+
+func TestJsonLinesResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	records := make(chan any)
+	go func() {
+		defer close(records)
+		records <- M{"n": 1}
+		records <- M{"n": func() {}} // cannot be marshaled, will be skipped
+		records <- M{"n": 2}
+		records <- M{"n": 3}
+	}()
+	var logbuf bytes.Buffer
+	log.SetOutput(&logbuf)
+	defer log.SetOutput(os.Stderr)
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	renderer.Render(w, r, NewJsonLinesResponse(records))
+	assertEq(t, 200, w.Code)
+	assertEq(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assertEq(t, "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", w.Body.String())
+	assertEq(t, true, w.Flushed)
+	assertEq(t, true, strings.Contains(logbuf.String(), "cannot marshal json line"))
+}
+
+func TestCorsHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "next "+r.Method)
+	})
+	handler := NewCorsHandler(next, Cors{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "X-Csrf-Token"},
+		ExposedHeaders:   []string{"X-Total-Count"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	serve := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	// same origin request
+	{
+		w := serve("GET", "", nil)
+		assertEq(t, "next GET", w.Body.String())
+		assertEq(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "", w.Header().Get("Vary"))
+	}
+	// allowed origin, origin is reflected
+	{
+		w := serve("GET", "https://app.example.com", nil)
+		assertEq(t, "next GET", w.Body.String())
+		assertEq(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+		assertEq(t, "X-Total-Count", w.Header().Get("Access-Control-Expose-Headers"))
+		assertEq(t, "Origin", w.Header().Get("Vary"))
+		assertEq(t, "", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	// other origin
+	{
+		w := serve("GET", "https://evil.example.com", nil)
+		assertEq(t, "next GET", w.Body.String())
+		assertEq(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+		assertEq(t, "Origin", w.Header().Get("Vary"))
+	}
+	// preflight
+	{
+		w := serve("OPTIONS", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "DELETE",
+			"Access-Control-Request-Headers": "content-type",
+		})
+		assertEq(t, 204, w.Code)
+		assertEq(t, "", w.Body.String())
+		assertEq(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+		assertEq(t, "GET, POST, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+		assertEq(t, "Content-Type, X-Csrf-Token", w.Header().Get("Access-Control-Allow-Headers"))
+		assertEq(t, "600", w.Header().Get("Access-Control-Max-Age"))
+		assertEq(t, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers", strings.Join(w.Header().Values("Vary"), ", "))
+	}
+	// plain OPTIONS request is not a preflight
+	{
+		w := serve("OPTIONS", "https://app.example.com", nil)
+		assertEq(t, "next OPTIONS", w.Body.String())
+	}
+	// wildcards and default methods
+	{
+		handler = NewCorsHandler(next, Cors{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}})
+		w := serve("OPTIONS", "https://any.example.com", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "x-foo, x-bar",
+		})
+		assertEq(t, 204, w.Code)
+		assertEq(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+		assertEq(t, "GET, HEAD, POST", w.Header().Get("Access-Control-Allow-Methods"))
+		assertEq(t, "x-foo, x-bar", w.Header().Get("Access-Control-Allow-Headers"))
+		assertEq(t, "", w.Header().Get("Access-Control-Max-Age"))
+		assertEq(t, "Access-Control-Request-Method, Access-Control-Request-Headers", strings.Join(w.Header().Values("Vary"), ", "))
+		w = serve("GET", "https://any.example.com", nil)
+		assertEq(t, "next GET", w.Body.String())
+		assertEq(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assertEq(t, "", w.Header().Get("Vary"))
+	}
+	// wildcard origin with credentials panics
+	{
+		var recovered any
+		func() {
+			defer func() { recovered = recover() }()
+			NewCorsHandler(next, Cors{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+		}()
+		assertEq(t, "cors: AllowedOrigins \"*\" must not be combined with AllowCredentials", recovered)
+	}
+}
+
+func TestServe(t *testing.T) {
+	// start serves handler, shuttingDown is closed when Shutdown has begun
+	start := func(handler http.Handler, grace time.Duration, stores ...SessionStore) (url string, stop chan<- os.Signal, shuttingDown <-chan struct{}, done <-chan error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assertEq(t, nil, err)
+		server := &http.Server{Handler: handler}
+		shutdownc := make(chan struct{})
+		server.RegisterOnShutdown(func() { close(shutdownc) })
+		stopc := make(chan os.Signal, 1)
+		donec := make(chan error, 1)
+		go func() {
+			donec <- serveUntil(server, func() error { return server.Serve(ln) }, stopc, grace, stores)
+		}()
+		return "http://" + ln.Addr().String(), stopc, shutdownc, donec
+	}
+	// in-flight requests complete
+	{
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "done")
+		})
+		store := &fakeSessionCleaner{SessionStore: NewMemorySessionStore()}
+		store.StartCleanup(time.Hour)
+		url, stop, shuttingDown, done := start(handler, 10*time.Second, store)
+		bodyc := make(chan string, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err != nil {
+				bodyc <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			data, _ := io.ReadAll(res.Body)
+			bodyc <- string(data)
+		}()
+		<-started
+		stop <- syscall.SIGTERM
+		<-shuttingDown
+		assertEq(t, true, store.running)
+		close(release)
+		assertEq(t, "done", <-bodyc)
+		assertEq(t, nil, <-done)
+		assertEq(t, false, store.running)
+	}
+	// grace period exceeded
+	{
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+		url, stop, _, done := start(handler, 10*time.Millisecond)
+		go http.Get(url)
+		<-started
+		stop <- syscall.SIGINT
+		err := <-done
+		assertEq(t, true, errors.Is(err, context.DeadlineExceeded))
+	}
+	// listen error
+	{
+		err := serveUntil(&http.Server{}, func() error { return errors.New("address in use") }, nil, time.Second, nil)
+		assertEq(t, "address in use", err.Error())
+	}
+}
+
+func TestCleanPathHandler(t *testing.T) {
+	var servedPath string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servedPath = r.URL.Path
+	})
+	serve := func(h http.Handler, method, target string) *httptest.ResponseRecorder {
+		servedPath = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	// clean path is passed through
+	{
+		serve(NewCleanPathHandler(next, false), "GET", "/api/users/")
+		assertEq(t, "/api/users/", servedPath)
+	}
+	// duplicate slashes are cleaned
+	{
+		serve(NewCleanPathHandler(next, false), "GET", "//api///users?id=1")
+		assertEq(t, "/api/users", servedPath)
+	}
+	// traversal attempt is neutralized
+	{
+		serve(NewCleanPathHandler(next, false), "GET", "/static/../../../etc/passwd")
+		assertEq(t, "/etc/passwd", servedPath)
+	}
+	// GET is redirected with query string
+	{
+		w := serve(NewCleanPathHandler(next, true), "GET", "//api///users/./?id=1")
+		assertEq(t, "", servedPath)
+		assertEq(t, 301, w.Code)
+		assertEq(t, "/api/users/?id=1", w.Header().Get("Location"))
+	}
+	// POST is not redirected
+	{
+		w := serve(NewCleanPathHandler(next, true), "POST", "//api///users")
+		assertEq(t, "/api/users", servedPath)
+		assertEq(t, 200, w.Code)
+	}
+}
+
+func TestWithStatus(t *testing.T) {
+	tpl := template.Must(template.New("page.html").Parse("invalid {{.name}}"))
+	renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// template defaults to 200
+	{
+		w := render(NewTemplateResponse("page.html", M{"name": "joe"}))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "invalid joe", w.Body.String())
+	}
+	// template with status
+	{
+		w := render(NewTemplateResponse("page.html", M{"name": "joe"}).WithStatus(422))
+		assertEq(t, 422, w.Code)
+		assertEq(t, "invalid joe", w.Body.String())
+	}
+	// json with status, chained in any order
+	{
+		w := render(NewJsonResponse(M{"id": 1}).WithHeader("X-Id", "1").WithStatus(201).WithCookie("c", "v", 0))
+		assertEq(t, 201, w.Code)
+		assertEq(t, `{"id":1}`, w.Body.String())
+		assertEq(t, "1", w.Header().Get("X-Id"))
+		assertEq(t, "c=v", w.Header().Get("Set-Cookie"))
+	}
+	// With methods do not modify the original response
+	{
+		base := NewJsonResponse(nil).WithHeader("X-A", "a").WithCookie("a", "a", 0)
+		derived := base.WithHeader("X-B", "b").WithCookie("b", "b", 0).WithStatus(201)
+		assertEq(t, 1, len(base.Headers))
+		assertEq(t, 1, len(base.Cookies))
+		assertEq(t, 0, base.StatusCode)
+		assertEq(t, 2, len(derived.Headers))
+		assertEq(t, 2, len(derived.Cookies))
+	}
+}
+
+func TestCache(t *testing.T) {
+	clock := &fakeClock{time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)}
+	// eviction on capacity
+	{
+		c := NewCache[string, int](2, clock)
+		c.Set("a", 1, 0)
+		c.Set("b", 2, 0)
+		_, ok := c.Get("a") // a is now most recently used
+		assertEq(t, true, ok)
+		c.Set("c", 3, 0) // evicts b
+		assertEq(t, 2, c.Len())
+		_, ok = c.Get("b")
+		assertEq(t, false, ok)
+		v, ok := c.Get("a")
+		assertEq(t, true, ok)
+		assertEq(t, 1, v)
+		v, ok = c.Get("c")
+		assertEq(t, true, ok)
+		assertEq(t, 3, v)
+		c.Delete("c")
+		_, ok = c.Get("c")
+		assertEq(t, false, ok)
+		assertEq(t, 1, c.Len())
+	}
+	// ttl expiry
+	{
+		c := NewCache[string, int](10, clock)
+		c.Set("a", 1, time.Minute)
+		c.Set("b", 2, 0)
+		clock.now = clock.now.Add(59 * time.Second)
+		_, ok := c.Get("a")
+		assertEq(t, true, ok)
+		clock.now = clock.now.Add(time.Second)
+		_, ok = c.Get("a")
+		assertEq(t, false, ok)
+		_, ok = c.Get("b")
+		assertEq(t, true, ok)
+		assertEq(t, 1, c.Len())
+	}
+	// concurrent access
+	{
+		c := NewCache[int, int](50, SystemClock)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					key := (i * j) % 100
+					c.Set(key, j, time.Minute)
+					c.Get(key)
+					if j%10 == 0 {
+						c.Delete(key)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		assertEq(t, true, c.Len() <= 50)
+	}
+}
+
+func TestIsSecure(t *testing.T) {
+	assertEq(t, nil, SetTrustedProxies("10.0.0.0/8"))
+	defer SetTrustedProxies()
+	// plain http
+	{
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		assertEq(t, false, NewRequest(r).IsSecure())
+	}
+	// direct TLS
+	{
+		r := httptest.NewRequest("GET", "https://example.com/", nil)
+		assertEq(t, true, NewRequest(r).IsSecure())
+	}
+	// trusted forwarded https
+	{
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = "10.1.2.3:4711"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		assertEq(t, true, NewRequest(r).IsSecure())
+		// the proxy's entry is the rightmost one
+		r.Header.Set("X-Forwarded-Proto", "https, http")
+		assertEq(t, false, NewRequest(r).IsSecure())
+		r.Header.Set("X-Forwarded-Proto", "http")
+		r.Header.Add("X-Forwarded-Proto", "https")
+		assertEq(t, true, NewRequest(r).IsSecure())
+	}
+	// untrusted forwarded header ignored
+	{
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = "192.168.1.1:4711"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		assertEq(t, false, NewRequest(r).IsSecure())
+	}
+	// invalid cidr
+	{
+		err := SetTrustedProxies("10.0.0.0/33")
+		assertEq(t, true, err != nil)
+	}
+}
+
+func TestSchemeAndHost(t *testing.T) {
+	assertEq(t, nil, SetTrustedProxies("10.0.0.0/8"))
+	defer SetTrustedProxies()
+	// direct
+	{
+		req := NewRequest(httptest.NewRequest("GET", "http://example.com:8080/", nil))
+		assertEq(t, "http", req.Scheme())
+		assertEq(t, "example.com:8080", req.Host())
+		req = NewRequest(httptest.NewRequest("GET", "https://example.com/", nil))
+		assertEq(t, "https", req.Scheme())
+		assertEq(t, "example.com", req.Host())
+	}
+	// trusted proxy
+	{
+		r := httptest.NewRequest("GET", "http://backend:8080/", nil)
+		r.RemoteAddr = "10.1.2.3:4711"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "www.example.com")
+		req := NewRequest(r)
+		assertEq(t, "https", req.Scheme())
+		assertEq(t, "www.example.com", req.Host())
+		assertEq(t, "https://www.example.com", req.Scheme()+"://"+req.Host())
+		r.Header.Del("X-Forwarded-Host")
+		assertEq(t, "backend:8080", req.Host())
+	}
+	// client-sent entries left of the proxy's entry are ignored
+	{
+		r := httptest.NewRequest("GET", "http://backend:8080/", nil)
+		r.RemoteAddr = "10.1.2.3:4711"
+		r.Header.Set("X-Forwarded-Host", "evil.example.com, www.example.com")
+		assertEq(t, "www.example.com", NewRequest(r).Host())
+		r.Header.Set("X-Forwarded-Host", "evil.example.com")
+		r.Header.Add("X-Forwarded-Host", "other.example.com, www.example.com ")
+		assertEq(t, "www.example.com", NewRequest(r).Host())
+	}
+	// untrusted forwarded headers are ignored
+	{
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = "192.168.1.1:4711"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "evil.example.com")
+		req := NewRequest(r)
+		assertEq(t, "http", req.Scheme())
+		assertEq(t, "example.com", req.Host())
+	}
+}
+
+func TestFSTemplateLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"templates/index.html": {Data: []byte(`Hello {{upper .name}}`)},
+		"templates/other.txt":  {Data: []byte(`not a template`)},
+	}
+	funcs := template.FuncMap{"upper": strings.ToUpper}
+	loader, err := NewFSTemplateLoader(fsys, "templates/*.html", funcs)
+	assertEq(t, nil, err)
+	renderer := NewResponseRenderer(loader)
+	w := httptest.NewRecorder()
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewTemplateResponse("index.html", M{"name": "joe"}))
+	assertEq(t, 200, w.Code)
+	assertEq(t, "Hello JOE", w.Body.String())
+	_, err = NewFSTemplateLoader(fsys, "nothing/*.html", funcs)
+	assertEq(t, true, err != nil)
+}
+
+func TestSessionManagerCookie(t *testing.T) {
+	store := NewMemorySessionStore()
+	manager := NewSessionManager(store, "SID", 24*time.Hour)
+	manager.CookieDomain = "example.com"
+	manager.CookieSecure = true
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	// login
+	var sessionId string
+	{
+		r := httptest.NewRequest("POST", "/login", nil)
+		session := NewSession().WithValue("user", "joe")
+		sessionId = session.Id()
+		res, err := manager.Save(NewRedirectResponse("/"), session)
+		assertEq(t, nil, err)
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		assertEq(t, "SID="+sessionId+"; Path=/; Domain=example.com; Max-Age=86400; HttpOnly; Secure; SameSite=Lax", w.Header().Get("Set-Cookie"))
+		assertEq(t, "joe", store.Find(sessionId).Get("user", ""))
+	}
+	// find
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "SID", Value: sessionId})
+		assertEq(t, "joe", manager.Find(NewRequest(r)).Get("user", ""))
+		assertEq(t, true, manager.Find(NewRequest(httptest.NewRequest("GET", "/", nil))).IsZero())
+	}
+	// logout
+	{
+		r := httptest.NewRequest("POST", "/logout", nil)
+		r.AddCookie(&http.Cookie{Name: "SID", Value: sessionId})
+		res, err := manager.Delete(NewRequest(r), NewRedirectResponse("/"))
+		assertEq(t, nil, err)
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		assertEq(t, "SID=; Path=/; Domain=example.com; Max-Age=0; HttpOnly; Secure; SameSite=Lax", w.Header().Get("Set-Cookie"))
+		assertEq(t, true, store.Find(sessionId).IsZero())
+	}
+}
+
+func TestLayoutResponse(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.html": {Data: []byte(`<html><title>{{.title}}</title><body>{{template "content" .}}</body></html>`)},
+		"index.html":  {Data: []byte(`<p>Hello {{.name}}</p>`)},
+		"about.html":  {Data: []byte(`<p>About {{.name}}</p>`)},
+		"broken.html": {Data: []byte(`<p>{{.name.foo}}</p>`)},
+	}
+	loader, err := NewFSTemplateLoader(fsys, "*.html", nil)
+	assertEq(t, nil, err)
+	renderer := NewResponseRenderer(loader)
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// plain template still works after layouts have been rendered
+	for i := 0; i < 2; i++ {
+		w := render(NewLayoutResponse("layout.html", "index.html", M{"title": "Index", "name": "joe"}))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "<html><title>Index</title><body><p>Hello joe</p></body></html>", w.Body.String())
+		w = render(NewLayoutResponse("layout.html", "about.html", M{"title": "About", "name": "joe"}))
+		assertEq(t, "<html><title>About</title><body><p>About joe</p></body></html>", w.Body.String())
+		w = render(NewTemplateResponse("index.html", M{"name": "joe"}))
+		assertEq(t, "<p>Hello joe</p>", w.Body.String())
+	}
+	// unknown layout
+	{
+		w := render(NewLayoutResponse("nolayout.html", "index.html", nil))
+		assertEq(t, 500, w.Code)
+		assertEq(t, true, strings.Contains(w.Body.String(), `layout template "nolayout.html" not found`))
+	}
+	// unknown content
+	{
+		w := render(NewLayoutResponse("layout.html", "nocontent.html", nil))
+		assertEq(t, 500, w.Code)
+		assertEq(t, true, strings.Contains(w.Body.String(), `content template "nocontent.html" not found`))
+	}
+	// error in content
+	{
+		w := render(NewLayoutResponse("layout.html", "broken.html", M{"name": "joe"}))
+		assertEq(t, 500, w.Code)
+		assertEq(t, true, strings.Contains(w.Body.String(), "cannot render broken.html in layout layout.html"))
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	// json
+	{
+		status, header, body, err := NewJsonResponse(M{"id": 1}).WithStatus(201).WithHeader("X-Id", "1").Materialize(nil)
+		assertEq(t, nil, err)
+		assertEq(t, 201, status)
+		assertEq(t, "1", header.Get("X-Id"))
+		assertEq(t, `{"id":1}`, string(body))
+	}
+	// template
+	{
+		tpl := template.Must(template.New("hello.html").Parse("Hello {{.name}}"))
+		status, _, body, err := NewTemplateResponse("hello.html", M{"name": "<joe>"}).Materialize(&fakeTemplateLoader{tpl})
+		assertEq(t, nil, err)
+		assertEq(t, 200, status)
+		assertEq(t, "Hello &lt;joe&gt;", string(body))
+	}
+	// template error
+	{
+		_, _, _, err := NewTemplateResponse("hello.html", nil).Materialize(nil)
+		assertEq(t, "cannot materialize response: cannot load templates: NullTemplateLoader cannot Load() anything", err.Error())
+		tpl := template.Must(template.New("hello.html").Parse("{{template \"missing\"}}"))
+		_, _, _, err = NewTemplateResponse("hello.html", nil).WithStatus(500).Materialize(&fakeTemplateLoader{tpl})
+		assertEq(t, true, strings.HasPrefix(err.Error(), "cannot materialize response: "))
+	}
+	// unsupported
+	{
+		_, _, _, err := NewFileResponse("webs.go", "", "").Materialize(nil)
+		assertEq(t, true, err != nil)
+	}
+}
+
+func TestRenderToString(t *testing.T) {
+	tpl := template.Must(template.New("mail.html").Parse("<p>Hello {{.name}}</p>"))
+	renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+	renderer.BodyFilter = func(contentType string, body []byte) []byte {
+		return bytes.ToUpper(body)
+	}
+	// template, with body filter
+	{
+		body, status, err := renderer.RenderToString(NewTemplateResponse("mail.html", M{"name": "<joe>"}))
+		assertEq(t, nil, err)
+		assertEq(t, 200, status)
+		assertEq(t, "<P>HELLO &LT;JOE&GT;</P>", body)
+	}
+	// status
+	{
+		body, status, err := renderer.RenderToString(NewJsonResponse(M{"id": 1}).WithStatus(201))
+		assertEq(t, nil, err)
+		assertEq(t, 201, status)
+		assertEq(t, `{"id":1}`, body)
+		body, status, err = renderer.RenderToString(NewStatusInternalServerErrorResponse("boom"))
+		assertEq(t, nil, err)
+		assertEq(t, 500, status)
+		assertEq(t, "boom", body)
+	}
+	// template error
+	{
+		_, _, err := renderer.RenderToString(NewTemplateResponse("none.html", nil))
+		assertEq(t, true, strings.HasPrefix(err.Error(), "cannot render none.html: "))
+		_, _, err = renderer.RenderToString(NewTemplateResponse("none.html", nil).WithStatus(500))
+		assertEq(t, true, strings.HasPrefix(err.Error(), "cannot render none.html: "))
+	}
+	// template error with custom error handler
+	{
+		renderer.ErrorHandler = func(w http.ResponseWriter, req *http.Request, msg string) {
+			http.Error(w, "please try again later", http.StatusServiceUnavailable)
+		}
+		_, _, err := renderer.RenderToString(NewTemplateResponse("none.html", nil))
+		assertEq(t, true, strings.HasPrefix(err.Error(), "cannot render none.html: "))
+		renderer.ErrorHandler = nil
+	}
+	// unsupported
+	{
+		_, _, err := renderer.RenderToString(NewStreamResponse(strings.NewReader("data"), "text/plain"))
+		assertEq(t, true, err != nil)
+	}
+}
+
+func TestNewSessionWithConfig(t *testing.T) {
+	// alphabets
+	for _, alphabet := range []string{SessionIdHex, SessionIdAlphanumeric, SessionIdBase64Url} {
+		session, err := NewSessionWithConfig(SessionConfig{IdLength: 40, IdAlphabet: alphabet})
+		assertEq(t, nil, err)
+		assertEq(t, 40, len(session.Id()))
+		assertEq(t, "", strings.Trim(session.Id(), alphabet))
+		assertEq(t, true, session.ExpiresAt().IsZero())
+		other, err := NewSessionWithConfig(SessionConfig{IdLength: 40, IdAlphabet: alphabet})
+		assertEq(t, nil, err)
+		assertEq(t, true, session.Id() != other.Id())
+	}
+	// all characters are used
+	{
+		session, err := NewSessionWithConfig(SessionConfig{IdLength: 2000, IdAlphabet: SessionIdBase64Url})
+		assertEq(t, nil, err)
+		for _, c := range SessionIdBase64Url {
+			assertEq(t, true, strings.ContainsRune(session.Id(), c))
+		}
+	}
+	// ttl
+	{
+		session, err := NewSessionWithConfig(SessionConfig{IdLength: 22, IdAlphabet: SessionIdBase64Url, TTL: time.Hour})
+		assertEq(t, nil, err)
+		assertEq(t, time.Hour, session.ExpiresAt().Sub(session.CreatedAt()))
+		session = session.WithValue("a", "1")
+		assertEq(t, "1", session.Get("a", ""))
+	}
+	// regenerate keeps the id config
+	{
+		config := SessionConfig{IdLength: 24, IdAlphabet: SessionIdBase64Url}
+		session, err := NewSessionWithConfig(config)
+		assertEq(t, nil, err)
+		regenerated, err := session.Regenerate()
+		assertEq(t, nil, err)
+		assertEq(t, 24, len(regenerated.Id()))
+		assertEq(t, "", strings.Trim(regenerated.Id(), SessionIdBase64Url))
+		store := NewMemorySessionStore()
+		assertEq(t, nil, store.Save(session))
+		regenerated, err = RegenerateSession(store, session)
+		assertEq(t, nil, err)
+		assertEq(t, 24, len(regenerated.Id()))
+		// session manager
+		manager := NewSessionManager(store, "SID", time.Hour)
+		manager.SessionConfig = config
+		rec := NewResponseRenderer(NewNullTemplateLoader()).Record(nil, manager.Update(NewTestRequest("POST", "/"), NewRedirectResponse("/"), func(session Session) Session {
+			return session.WithValue("name", "joe")
+		}))
+		id := rec.Cookie("SID").Value
+		assertEq(t, 24, len(id))
+		rec = NewResponseRenderer(NewNullTemplateLoader()).Record(nil, manager.Update(NewTestRequest("POST", "/login").WithCookie("SID", id), NewRedirectResponse("/"), func(session Session) Session {
+			regenerated, err := session.Regenerate()
+			assertEq(t, nil, err)
+			return regenerated
+		}))
+		newId := rec.Cookie("SID").Value
+		assertEq(t, true, newId != id)
+		assertEq(t, 24, len(newId))
+		assertEq(t, "", strings.Trim(newId, SessionIdBase64Url))
+	}
+	// session manager with a TTL but no id config
+	{
+		store := NewMemorySessionStore()
+		manager := NewSessionManager(store, "SID", 0)
+		manager.SessionConfig = SessionConfig{TTL: time.Hour}
+		rec := NewResponseRenderer(NewNullTemplateLoader()).Record(nil, manager.Update(NewTestRequest("POST", "/"), NewRedirectResponse("/"), func(session Session) Session {
+			return session.WithValue("name", "joe")
+		}))
+		id := rec.Cookie("SID").Value
+		assertEq(t, 32, len(id))
+		session := store.Find(id)
+		assertEq(t, "joe", session.Get("name", ""))
+		assertEq(t, time.Hour, session.ExpiresAt().Sub(session.CreatedAt()))
+		// the manager's TTL is used if SessionConfig has none
+		manager = NewSessionManager(store, "SID", 2*time.Hour)
+		rec = NewResponseRenderer(NewNullTemplateLoader()).Record(nil, manager.Update(NewTestRequest("POST", "/"), NewRedirectResponse("/"), func(session Session) Session {
+			return session.WithValue("name", "joe")
+		}))
+		session = store.Find(rec.Cookie("SID").Value)
+		assertEq(t, "joe", session.Get("name", ""))
+		assertEq(t, 2*time.Hour, session.ExpiresAt().Sub(session.CreatedAt()))
+	}
+	// minimum length
+	assertEq(t, nil, SessionConfig{IdLength: 32, IdAlphabet: SessionIdHex}.Validate())
+	assertEq(t, nil, SessionConfig{IdLength: 22, IdAlphabet: SessionIdBase64Url}.Validate())
+	assertEq(t, nil, SessionConfig{IdLength: 22, IdAlphabet: SessionIdAlphanumeric}.Validate())
+	// invalid
+	{
+		_, err := NewSessionWithConfig(SessionConfig{IdLength: 31, IdAlphabet: SessionIdHex})
+		assertEq(t, "invalid session config: ids of length 31 have 124 bits of entropy, must have at least 128", err.Error())
+		err = SessionConfig{IdLength: 21, IdAlphabet: SessionIdBase64Url}.Validate()
+		assertEq(t, "invalid session config: ids of length 21 have 126 bits of entropy, must have at least 128", err.Error())
+		err = SessionConfig{IdLength: 100, IdAlphabet: "01234567"}.Validate()
+		assertEq(t, "invalid session config: alphabet must have at least 16 characters, has 8", err.Error())
+		err = SessionConfig{IdLength: 100, IdAlphabet: "0123456789abcdef;"}.Validate()
+		assertEq(t, `invalid session config: alphabet contains invalid character ';'`, err.Error())
+		err = SessionConfig{IdLength: 100, IdAlphabet: "0123456789abcdea"}.Validate()
+		assertEq(t, `invalid session config: alphabet contains 'a' twice`, err.Error())
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	// IsExpired
+	{
+		assertEq(t, false, NewSession().IsExpired())
+		assertEq(t, true, NewSession().ExpiresAt().IsZero())
+		assertEq(t, false, NewSession().CreatedAt().IsZero())
+		assertEq(t, false, NewSessionWithTTL(time.Hour).IsExpired())
+		assertEq(t, true, NewSessionWithTTL(-time.Second).IsExpired())
+	}
+	// stores do not find expired sessions
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	fileStore, err := NewFileSessionStore(filename)
+	assertEq(t, nil, err)
+	for _, store := range []SessionStore{NewMemorySessionStore(), fileStore} {
+		valid := NewSessionWithTTL(time.Hour).WithValue("a", "1")
+		expired := NewSessionWithTTL(-time.Second).WithValue("a", "1")
+		assertEq(t, nil, store.Save(valid))
+		assertEq(t, nil, store.Save(expired))
+		assertEq(t, "1", store.Find(valid.Id()).Get("a", ""))
+		assertEq(t, true, store.Find(expired.Id()).IsZero())
+	}
+	// file store persists timestamps
+	{
+		session := NewSessionWithTTL(time.Hour).WithValue("a", "1")
+		assertEq(t, nil, fileStore.Save(session))
+		reloaded, err := NewFileSessionStore(filename)
+		assertEq(t, nil, err)
+		found := reloaded.Find(session.Id())
+		assertEq(t, "1", found.Get("a", ""))
+		assertEq(t, session.CreatedAt().UnixMilli(), found.CreatedAt().UnixMilli())
+		assertEq(t, session.ExpiresAt().UnixMilli(), found.ExpiresAt().UnixMilli())
+	}
+	// file store reads old format
+	{
+		oldFilename := filepath.Join(t.TempDir(), "old.json")
+		err := os.WriteFile(oldFilename, []byte(`{"abc":{"name":"joe"}}`), 0644)
+		assertEq(t, nil, err)
+		store, err := NewFileSessionStore(oldFilename)
+		assertEq(t, nil, err)
+		found := store.Find("abc")
+		assertEq(t, "joe", found.Get("name", ""))
+		assertEq(t, false, found.IsExpired())
+		assertEq(t, nil, store.Save(found.WithValue("age", "42")))
+		store, err = NewFileSessionStore(oldFilename)
+		assertEq(t, nil, err)
+		assertEq(t, "42", store.Find("abc").Get("age", ""))
+	}
+}
+
+func TestSessionCleanup(t *testing.T) {
+	fileStore, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	assertEq(t, nil, err)
+	for _, store := range []SessionStore{NewMemorySessionStore(), fileStore} {
+		shortLived := NewSessionWithTTL(20 * time.Millisecond)
+		longLived := NewSessionWithTTL(time.Hour)
+		assertEq(t, nil, store.Save(shortLived))
+		assertEq(t, nil, store.Save(longLived))
+		cleaner := store.(SessionCleaner)
+		cleaner.StartCleanup(5 * time.Millisecond)
+		// concurrent saves must not deadlock with cleanup
+		for i := 0; i < 10; i++ {
+			assertEq(t, nil, store.Save(NewSessionWithTTL(time.Hour)))
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for len(store.FindAll()) != 11 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cleaner.StopCleanup()
+		cleaner.StopCleanup() // no-op
+		assertEq(t, 11, len(store.FindAll()))
+		assertEq(t, false, store.Find(longLived.Id()).IsZero())
+	}
+}
+
+func TestBodyFilter(t *testing.T) {
+	tpl := template.Must(template.New("page.html").Parse("<html><body>Hello {{.name}}</body></html>"))
+	renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+	renderer.BodyFilter = func(contentType string, body []byte) []byte {
+		return bytes.Replace(body, []byte("</body>"), []byte("<script>reload()</script></body>"), 1)
+	}
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// template
+	{
+		w := render(NewTemplateResponse("page.html", M{"name": "joe"}).WithStatus(201))
+		assertEq(t, 201, w.Code)
+		assertEq(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "<html><body>Hello joe<script>reload()</script></body></html>", w.Body.String())
+	}
+	// html content
+	{
+		w := render(NewHtmlResponse("<body>fragment</body>"))
+		assertEq(t, "<body>fragment<script>reload()</script></body>", w.Body.String())
+	}
+	// non-html content is not filtered
+	{
+		w := render(NewContentResponse([]byte("<body>text</body>"), "text/plain", ""))
+		assertEq(t, "<body>text</body>", w.Body.String())
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	store := NewMemorySessionStore()
+	session := NewSession().WithValue("name", "joe")
+	// no flashes
+	flashes, session := session.Flashes()
+	assertEq(t, 0, len(flashes))
+	// add flashes and save, like before a redirect
+	session = session.AddFlash("saved").AddFlash("welcome")
+	assertEq(t, "name", strings.Join(session.Keys(), ","))
+	assertEq(t, nil, store.Save(session))
+	// read flashes after redirect
+	session = store.Find(session.Id())
+	flashes, cleared := session.Flashes()
+	assertEq(t, 2, len(flashes))
+	assertEq(t, "saved", flashes[0])
+	assertEq(t, "welcome", flashes[1])
+	assertEq(t, "joe", cleared.Get("name", ""))
+	assertEq(t, nil, store.Save(cleared))
+	// flashes are shown only once
+	flashes, _ = store.Find(session.Id()).Flashes()
+	assertEq(t, 0, len(flashes))
+	// original session is not modified
+	flashes, _ = session.Flashes()
+	assertEq(t, 2, len(flashes))
+}
+
+func TestWithoutValue(t *testing.T) {
+	session := NewSession().WithValue("user", "joe").WithValue("theme", "dark")
+	loggedOut := session.WithoutValue("user")
+	assertEq(t, "theme", strings.Join(loggedOut.Keys(), ","))
+	assertEq(t, "", loggedOut.Get("user", ""))
+	assertEq(t, "dark", loggedOut.Get("theme", ""))
+	assertEq(t, session.Id(), loggedOut.Id())
+	// original session is not modified
+	assertEq(t, "theme,user", strings.Join(session.Keys(), ","))
+	// removing a missing key is a no-op
+	assertEq(t, "theme", strings.Join(loggedOut.WithoutValue("user").Keys(), ","))
+}
+
+func TestRateLimited(t *testing.T) {
+	clock := &fakeClock{time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)}
+	loginLimiter := NewRateLimiter(5, time.Minute, clock)
+	readLimiter := NewRateLimiter(100, time.Minute, clock)
+	ok := func(req Request) Response { return NewStatusResponse(200, "ok") }
+	clientIp := func(req Request) string { return req.Header("X-Client") }
+	login := RateLimited(loginLimiter, "/login", clientIp, ok)
+	read := RateLimited(readLimiter, "/read", clientIp, ok)
+	newRequest := func(ip string) Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Client", ip)
+		return NewRequest(r)
+	}
+	// exhaust the login limit
+	for i := 0; i < 5; i++ {
+		assertEq(t, 200, login(newRequest("1.1.1.1")).StatusCode)
+	}
+	assertEq(t, 429, login(newRequest("1.1.1.1")).StatusCode)
+	// read endpoint remains available for the same ip
+	for i := 0; i < 10; i++ {
+		assertEq(t, 200, read(newRequest("1.1.1.1")).StatusCode)
+	}
+	// login remains available for other ips
+	assertEq(t, 200, login(newRequest("2.2.2.2")).StatusCode)
+	// a shared limiter counts routes independently
+	other := RateLimited(loginLimiter, "/other", clientIp, ok)
+	assertEq(t, 200, other(newRequest("1.1.1.1")).StatusCode)
+	// tokens are refilled over time
+	clock.now = clock.now.Add(12 * time.Second)
+	assertEq(t, 200, login(newRequest("1.1.1.1")).StatusCode)
+	res := login(newRequest("1.1.1.1"))
+	assertEq(t, 429, res.StatusCode)
+	assertEq(t, "12", res.Headers["Retry-After"])
+	// full buckets are pruned
+	assertEq(t, 3, loginLimiter.Len())
+	clock.now = clock.now.Add(time.Minute)
+	assertEq(t, 200, login(newRequest("3.3.3.3")).StatusCode)
+	assertEq(t, 1, loginLimiter.Len())
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := &fakeClock{time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)}
+	router := NewRouter(NewResponseRenderer(NewNullTemplateLoader()))
+	router.Use(RateLimitMiddleware(NewRateLimiter(2, time.Second, clock), Request.RemoteIP))
+	router.Handle("/a", func(req Request) Response { return NewStringResponse("a") })
+	router.Handle("/b", func(req Request) Response { return NewStringResponse("b") })
+	serve := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	assertEq(t, 200, serve("/a", "1.1.1.1:1000").Code)
+	assertEq(t, 200, serve("/b", "1.1.1.1:1001").Code)
+	w := serve("/a", "1.1.1.1:1002")
+	assertEq(t, 429, w.Code)
+	assertEq(t, "1", w.Header().Get("Retry-After"))
+	assertEq(t, 200, serve("/a", "2.2.2.2:1000").Code)
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	assertEq(t, 200, serve("/a", "1.1.1.1:1000").Code)
+}
+
+func TestStartTime(t *testing.T) {
+	clock := &fakeClock{time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)}
+	var startTime time.Time
+	var elapsed time.Duration
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := NewRequest(r)
+		clock.now = clock.now.Add(42 * time.Millisecond)
+		startTime = req.StartTime()
+		elapsed = clock.Now().Sub(req.StartTime())
+	})
+	NewStartTimeHandler(next, clock).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assertEq(t, time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC), startTime)
+	assertEq(t, 42*time.Millisecond, elapsed)
+	// not recorded
+	assertEq(t, true, NewRequest(httptest.NewRequest("GET", "/", nil)).StartTime().IsZero())
+}
+
+func TestWithCookieOpts(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	res := NewRedirectResponse("/").WithCookieOpts("auth", "abc", time.Hour, CookieOptions{
+		Path:     "/app",
+		Domain:   "example.com",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}).WithCookie("theme", "dark", 0)
+	w := httptest.NewRecorder()
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+	cookies := w.Header().Values("Set-Cookie")
+	assertEq(t, 2, len(cookies))
+	assertEq(t, "auth=abc; Path=/app; Domain=example.com; Max-Age=3600; HttpOnly; Secure; SameSite=Strict", cookies[0])
+	assertEq(t, "theme=dark", cookies[1])
+}
+
+func TestWithCookieExpires(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	res := NewStringResponse("ok").WithCookieExpires("promo", "x", expires).WithCookieOpts("both", "y", time.Hour, CookieOptions{Path: "/", Expires: expires})
+	w := httptest.NewRecorder()
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+	cookies := w.Header().Values("Set-Cookie")
+	assertEq(t, 2, len(cookies))
+	assertEq(t, "promo=x; Expires=Wed, 02 Jan 2030 03:04:05 GMT", cookies[0])
+	assertEq(t, "both=y; Path=/; Expires=Wed, 02 Jan 2030 03:04:05 GMT; Max-Age=3600", cookies[1])
+}
+
+func TestCsrf(t *testing.T) {
+	session := NewSession()
+	assertEq(t, false, ValidateCsrf(session, ""))
+	token, session2 := session.CsrfToken()
+	assertEq(t, 43, len(token)) // 32 bytes, base64
+	assertEq(t, "", session.Get(CsrfTokenKey, ""))
+	// token is created once
+	token2, session3 := session2.CsrfToken()
+	assertEq(t, token, token2)
+	assertEq(t, session2.Get(CsrfTokenKey, ""), session3.Get(CsrfTokenKey, ""))
+	// validate
+	assertEq(t, true, ValidateCsrf(session2, token))
+	assertEq(t, false, ValidateCsrf(session2, token+"x"))
+	assertEq(t, false, ValidateCsrf(session2, ""))
+	assertEq(t, false, ValidateCsrf(session, token))
+	// tokens are random
+	assertEq(t, true, GenerateToken(16) != GenerateToken(16))
+}
+
+func TestEmptyFindAll(t *testing.T) {
+	fileStore, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	assertEq(t, nil, err)
+	for _, store := range []SessionStore{NewMemorySessionStore(), fileStore} {
+		all := store.FindAll()
+		assertEq(t, true, all != nil)
+		assertEq(t, 0, len(all))
+		data, err := json.Marshal(all)
+		assertEq(t, nil, err)
+		assertEq(t, "[]", string(data))
+		page, err := store.(SessionPager).FindPage(0, 10)
+		assertEq(t, nil, err)
+		assertEq(t, true, page != nil)
+		assertEq(t, 0, len(page))
+	}
+}
+
+func TestSessionStoreCopies(t *testing.T) {
+	fileStore, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	assertEq(t, nil, err)
+	for _, store := range []SessionStore{NewMemorySessionStore(), fileStore} {
+		session := NewSession().WithValue("a", "1")
+		assertEq(t, nil, store.Save(session))
+		// callers do not alias the store's values
+		{
+			session.values["a"] = "changed"
+			store.Find(session.Id()).values["a"] = "changed"
+			store.FindAll()[0].values["a"] = "changed"
+			page, _ := store.(SessionPager).FindPage(0, 1)
+			page[0].values["a"] = "changed"
+			assertEq(t, "1", store.Find(session.Id()).Get("a", ""))
+		}
+		// concurrent readers and writers
+		{
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						s := store.Find(session.Id())
+						store.Save(s.WithValue("w"+strconv.Itoa(i), strconv.Itoa(j)))
+					}
+				}(i)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						for _, s := range store.FindAll() {
+							for _, key := range s.Keys() {
+								s.Get(key, "")
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			assertEq(t, "1", store.Find(session.Id()).Get("a", ""))
+		}
+	}
+}
+
+func TestRegenerateSession(t *testing.T) {
+	store := NewMemorySessionStore()
+	session := NewSessionWithTTL(time.Hour).WithValue("user", "joe")
+	assertEq(t, nil, store.Save(session))
+	// session
+	{
+		regenerated, err := session.Regenerate()
+		assertEq(t, nil, err)
+		assertEq(t, true, regenerated.Id() != session.Id())
+		assertEq(t, 32, len(regenerated.Id()))
+		assertEq(t, "joe", regenerated.Get("user", ""))
+		assertEq(t, session.ExpiresAt(), regenerated.ExpiresAt())
+		other, err := session.Regenerate()
+		assertEq(t, nil, err)
+		assertEq(t, true, regenerated.Id() != other.Id())
+	}
+	// store
+	{
+		regenerated, err := RegenerateSession(store, session)
+		assertEq(t, nil, err)
+		assertEq(t, true, store.Find(session.Id()).IsZero())
+		assertEq(t, "joe", store.Find(regenerated.Id()).Get("user", ""))
+		assertEq(t, 1, len(store.FindAll()))
+		session = regenerated
+	}
+	// session manager
+	{
+		manager := NewSessionManager(store, "sid", time.Hour)
+		login := manager.Wrap(func(req Request, session *Session) Response {
+			regenerated, err := session.Regenerate()
+			if err != nil {
+				return NewStatusInternalServerErrorResponse("cannot regenerate session: %s", err)
+			}
+			*session = regenerated.WithValue("user", "admin")
+			return NewRedirectResponse("/")
+		})
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.AddCookie(&http.Cookie{Name: "sid", Value: session.Id()})
+		res := login(NewRequest(r))
+		assertEq(t, 1, len(res.Cookies))
+		newId := res.Cookies[0].Value
+		assertEq(t, true, newId != session.Id())
+		assertEq(t, true, store.Find(session.Id()).IsZero())
+		assertEq(t, "admin", store.Find(newId).Get("user", ""))
+		assertEq(t, 1, len(store.FindAll()))
+	}
+	// failing delete is rolled back
+	{
+		session := NewSession().WithValue("user", "joe")
+		store := &failingSessionStore{SessionStore: NewMemorySessionStore(), failDeleteId: session.Id()}
+		assertEq(t, nil, store.Save(session))
+		result, err := RegenerateSession(store, session)
+		assertEq(t, "cannot delete old session: delete failed", err.Error())
+		assertEq(t, session.Id(), result.Id())
+		assertEq(t, 1, len(store.FindAll()))
+		assertEq(t, "joe", store.Find(session.Id()).Get("user", ""))
+	}
+}
+
+func TestWithValues(t *testing.T) {
+	session := NewSession().WithValue("a", "1").WithValue("b", "2")
+	session2 := session.WithValues(map[string]string{"b": "20", "c": "30"})
+	assertEq(t, "a,b,c", strings.Join(session2.Keys(), ","))
+	assertEq(t, "1", session2.Get("a", ""))
+	assertEq(t, "20", session2.Get("b", ""))
+	assertEq(t, "30", session2.Get("c", ""))
+	// original is unchanged
+	assertEq(t, "a,b", strings.Join(session.Keys(), ","))
+	assertEq(t, "2", session.Get("b", ""))
+	// zero session and nil map
+	assertEq(t, "x", Session{}.WithValues(map[string]string{"k": "x"}).Get("k", ""))
+	assertEq(t, 2, len(session.WithValues(nil).Keys()))
+}
+
+func TestSessionTypedValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := NewFileSessionStore(filename)
+	assertEq(t, nil, err)
+	session := NewSession().WithInt("count", 42).WithInt("neg", -7).WithBool("admin", true).WithValue("name", "joe")
+	assertEq(t, nil, store.Save(session))
+	// round trip through file
+	store, err = NewFileSessionStore(filename)
+	assertEq(t, nil, err)
+	session = store.Find(session.Id())
+	assertEq(t, 42, session.GetInt("count", 0))
+	assertEq(t, -7, session.GetInt("neg", 0))
+	assertEq(t, true, session.GetBool("admin", false))
+	assertEq(t, "42", session.Get("count", ""))
+	assertEq(t, "true", session.Get("admin", ""))
+	// defaults
+	assertEq(t, 5, session.GetInt("missing", 5))
+	assertEq(t, 5, session.GetInt("name", 5))
+	assertEq(t, true, session.GetBool("missing", true))
+	assertEq(t, false, session.GetBool("name", false))
+	assertEq(t, false, session.WithBool("admin", false).GetBool("admin", true))
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	client := &fakeRedisClient{data: make(map[string]string), ttls: make(map[string]time.Duration)}
+	store := NewRedisSessionStore(client, "session:")
+	// save and find
+	session := NewSessionWithTTL(time.Hour).WithValue("name", "joe")
+	{
+		assertEq(t, nil, store.Save(session))
+		assertEq(t, true, client.ttls["session:"+session.Id()] > 59*time.Minute)
+		found := store.Find(session.Id())
+		assertEq(t, session.Id(), found.Id())
+		assertEq(t, "joe", found.Get("name", ""))
+		assertEq(t, session.ExpiresAt().UnixMilli(), found.ExpiresAt().UnixMilli())
+		assertEq(t, true, store.Find("unknown").IsZero())
+	}
+	// same JSON format as FileSessionStore
+	{
+		filename := filepath.Join(t.TempDir(), "sessions.json")
+		fileStore, err := NewFileSessionStore(filename)
+		assertEq(t, nil, err)
+		assertEq(t, nil, fileStore.Save(session))
+		data, err := os.ReadFile(filename)
+		assertEq(t, nil, err)
+		var jsessions map[string]json.RawMessage
+		assertEq(t, nil, json.Unmarshal(data, &jsessions))
+		assertEq(t, string(jsessions[session.Id()]), client.data["session:"+session.Id()])
+	}
+	// no expiry
+	{
+		forever := NewSession()
+		assertEq(t, nil, store.Save(forever))
+		assertEq(t, time.Duration(0), client.ttls["session:"+forever.Id()])
+		assertEq(t, false, store.Find(forever.Id()).IsZero())
+	}
+	// find all ignores other keys
+	{
+		client.data["other:1"] = "x"
+		all := store.FindAll()
+		assertEq(t, 2, len(all))
+		assertEq(t, true, all[0].Id() < all[1].Id())
+	}
+	// delete
+	{
+		assertEq(t, nil, store.Delete(session.Id()))
+		assertEq(t, true, store.Find(session.Id()).IsZero())
+		assertEq(t, 1, len(store.FindAll()))
+	}
+	// errors
+	{
+		var logbuf bytes.Buffer
+		log.SetOutput(&logbuf)
+		defer log.SetOutput(os.Stderr)
+		client.err = errors.New("connection refused")
+		assertEq(t, true, store.Find("x").IsZero())
+		assertEq(t, 0, len(store.FindAll()))
+		assertEq(t, client.err, store.Save(NewSession()))
+		assertEq(t, true, strings.Contains(logbuf.String(), "connection refused"))
+	}
+}
+
+func TestShardedSessionStore(t *testing.T) {
+	stores := []SessionStore{NewMemorySessionStore(), NewMemorySessionStore(), NewMemorySessionStore()}
+	sharded := NewShardedSessionStore(stores, nil)
+	var ids []string
+	for i := 0; i < 30; i++ {
+		session := NewSession().WithValue("i", strconv.Itoa(i))
+		ids = append(ids, session.Id())
+		assertEq(t, nil, sharded.Save(session))
+	}
+	sort.Strings(ids)
+	// ids route consistently
+	for _, id := range ids {
+		index := HashShard(id, 3)
+		assertEq(t, index, HashShard(id, 3))
+		assertEq(t, false, stores[index].Find(id).IsZero())
+		assertEq(t, false, sharded.Find(id).IsZero())
+	}
+	// every store got some sessions
+	for _, store := range stores {
+		assertEq(t, true, len(store.FindAll()) > 0)
+	}
+	// FindAll returns the union, sorted
+	all := sharded.FindAll()
+	assertEq(t, 30, len(all))
+	assertEq(t, 30, sharded.Count())
+	for i, session := range all {
+		assertEq(t, ids[i], session.Id())
+	}
+	page, err := sharded.FindPage(10, 5)
+	assertEq(t, nil, err)
+	assertEq(t, 5, len(page))
+	assertEq(t, ids[10], page[0].Id())
+	// pages are merged from all stores
+	for offset := 0; offset <= 30; offset += 7 {
+		page, err := sharded.FindPage(offset, 7)
+		assertEq(t, nil, err)
+		var pageIds []string
+		for _, session := range page {
+			pageIds = append(pageIds, session.Id())
+		}
+		end := offset + 7
+		if end > 30 {
+			end = 30
+		}
+		assertEq(t, strings.Join(ids[offset:end], ","), strings.Join(pageIds, ","))
+	}
+	// stores that are no SessionPager or SessionCounter
+	{
+		sharded := NewShardedSessionStore([]SessionStore{&countingSessionStore{SessionStore: stores[0]}, stores[1], stores[2]}, nil)
+		assertEq(t, 30, sharded.Count())
+		page, err := sharded.FindPage(28, 5)
+		assertEq(t, nil, err)
+		assertEq(t, 2, len(page))
+		assertEq(t, ids[29], page[1].Id())
+	}
+	// delete
+	assertEq(t, nil, sharded.Delete(ids[0]))
+	assertEq(t, true, sharded.Find(ids[0]).IsZero())
+	assertEq(t, 29, sharded.Count())
+	// custom shard func
+	{
+		stores := []SessionStore{NewMemorySessionStore(), NewMemorySessionStore()}
+		byPrefix := func(id string, n int) int {
+			if strings.HasPrefix(id, "a") {
+				return 0
+			}
+			return 1
+		}
+		sharded := NewShardedSessionStore(stores, byPrefix)
+		assertEq(t, nil, sharded.Save(Session{id: "a1"}))
+		assertEq(t, nil, sharded.Save(Session{id: "b1"}))
+		assertEq(t, "a1", stores[0].FindAll()[0].Id())
+		assertEq(t, "b1", stores[1].FindAll()[0].Id())
+	}
+}
+
+func TestPdfResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	data := []byte("%PDF-1.4")
+	// inline
+	{
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewPdfResponse(data, "report 2023.pdf", true))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "application/pdf", w.Header().Get("Content-Type"))
+		assertEq(t, `inline; filename="report 2023.pdf"`, w.Header().Get("Content-Disposition"))
+		assertEq(t, "%PDF-1.4", w.Body.String())
+	}
+	// attachment
+	{
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewPdfResponse(data, "report.pdf", false))
+		assertEq(t, "application/pdf", w.Header().Get("Content-Type"))
+		assertEq(t, "attachment; filename=report.pdf", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestErrorHandlers(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// default behavior
+	{
+		assertEq(t, true, Response{}.IsZero())
+		assertEq(t, true, Response{}.WithHeader("X-Foo", "1").IsZero())
+		assertEq(t, false, NewStringResponse("").IsZero())
+		w := render(Response{})
+		assertEq(t, 404, w.Code)
+		assertEq(t, "404 page not found\n", w.Body.String())
+		w = render(Response{}.WithHeader("X-Foo", "1"))
+		assertEq(t, 404, w.Code)
+		assertEq(t, "1", w.Header().Get("X-Foo"))
+		w = render(NewTemplateResponse("index.html", nil))
+		assertEq(t, 500, w.Code)
+	}
+	renderer.NotFoundHandler = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+		io.WriteString(w, "<h1>Not here</h1>")
+	}
+	renderer.ErrorHandler = func(w http.ResponseWriter, req *http.Request, msg string) {
+		w.WriteHeader(500)
+		io.WriteString(w, "<h1>Oops</h1><!-- "+msg+" -->")
+	}
+	// custom not found
+	{
+		w := render(Response{})
+		assertEq(t, 404, w.Code)
+		assertEq(t, "<h1>Not here</h1>", w.Body.String())
+		w = render(NewStatusNotFoundResponse("no user %d", 42))
+		assertEq(t, 404, w.Code)
+		assertEq(t, "<h1>Not here</h1>", w.Body.String())
+	}
+	// custom error
+	{
+		w := render(NewStatusInternalServerErrorResponse("db down"))
+		assertEq(t, 500, w.Code)
+		assertEq(t, "<h1>Oops</h1><!-- db down -->", w.Body.String())
+		w = render(NewTemplateResponse("index.html", nil))
+		assertEq(t, 500, w.Code)
+		assertEq(t, true, strings.HasPrefix(w.Body.String(), "<h1>Oops</h1><!-- cannot load templates"))
+	}
+	// other status codes are not routed
+	{
+		w := render(NewStatusResponse(403, "forbidden"))
+		assertEq(t, 403, w.Code)
+		assertEq(t, "forbidden", w.Body.String())
+	}
+}
+
+func TestStringResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	w := render(NewStringResponse("ok"))
+	assertEq(t, 200, w.Code)
+	assertEq(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assertEq(t, "ok", w.Body.String())
+	w = render(NewTextResponse("unhealthy").WithStatus(503))
+	assertEq(t, 503, w.Code)
+	assertEq(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assertEq(t, "unhealthy", w.Body.String())
+}
+
+func TestWithHeaderValues(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	base := NewStringResponse("ok").WithHeaderValues("Link", `</style.css>; rel=preload`)
+	res := base.WithHeaderValues("Link", `</app.js>; rel=preload`).WithHeader("X-Id", "1")
+	w := httptest.NewRecorder()
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+	links := w.Header().Values("Link")
+	assertEq(t, 2, len(links))
+	assertEq(t, `</style.css>; rel=preload`, links[0])
+	assertEq(t, `</app.js>; rel=preload`, links[1])
+	assertEq(t, "1", w.Header().Get("X-Id"))
+	// original response is not modified
+	assertEq(t, 1, len(base.HeaderValues["Link"]))
+}
+
+func TestXmlResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	type user struct {
+		XMLName xml.Name `xml:"user"`
+		Name    string   `xml:"name"`
+	}
+	w := render(NewXmlResponse(user{Name: "joe"}))
+	assertEq(t, 200, w.Code)
+	assertEq(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assertEq(t, xml.Header+"<user><name>joe</name></user>", w.Body.String())
+	w = render(NewXmlResponse(user{Name: "joe"}).WithStatus(201))
+	assertEq(t, 201, w.Code)
+	w = render(NewXmlResponse(map[string]string{"name": "joe"})) // maps are not supported
+	assertEq(t, 500, w.Code)
+	assertEq(t, true, strings.HasPrefix(w.Body.String(), "cannot marshal xml"))
+}
+
+func TestCspNonceHandler(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html": {Data: []byte(`<script nonce="{{cspNonce}}">go()</script>`)},
+	}
+	loader, err := NewFSTemplateLoader(fsys, "*.html", nil)
+	assertEq(t, nil, err)
+	renderer := NewResponseRenderer(loader)
+	var handlerNonce string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := NewRequest(r)
+		handlerNonce = req.CspNonce()
+		renderer.Render(w, r, NewTemplateResponse("page.html", nil))
+	})
+	csp := NewCspNonceHandler(handler, "default-src 'self'; script-src 'nonce-{nonce}'")
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		csp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assertEq(t, 200, w.Code)
+		assertEq(t, 22, len(handlerNonce))
+		assertEq(t, "default-src 'self'; script-src 'nonce-"+handlerNonce+"'", w.Header().Get("Content-Security-Policy"))
+		assertEq(t, `<script nonce="`+handlerNonce+`">go()</script>`, w.Body.String())
+		nonces = append(nonces, handlerNonce)
+	}
+	assertEq(t, true, nonces[0] != nonces[1])
+	// without handler, cspNonce is empty
+	w := httptest.NewRecorder()
+	renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewTemplateResponse("page.html", nil))
+	assertEq(t, `<script nonce="">go()</script>`, w.Body.String())
+	assertEq(t, "", NewRequest(httptest.NewRequest("GET", "/", nil)).CspNonce())
+}
+
+func TestIndentedJsonResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	w := render(NewIndentedJsonResponse(M{"user": M{"name": "joe"}}, "  "))
+	assertEq(t, 200, w.Code)
+	assertEq(t, "{\n  \"user\": {\n    \"name\": \"joe\"\n  }\n}", w.Body.String())
+	w = render(NewJsonResponse(M{"user": M{"name": "joe"}}))
+	assertEq(t, `{"user":{"name":"joe"}}`, w.Body.String())
+	w = render(NewIndentedJsonResponse(M{"f": func() {}}, "  "))
+	assertEq(t, 500, w.Code)
+	assertEq(t, true, strings.HasPrefix(w.Body.String(), "cannot marshal json"))
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := NewRouter(NewResponseRenderer(NewNullTemplateLoader()))
+	router.Handle("/api/users", func(req Request) Response {
+		return NewJsonResponse([]string{"joe"})
+	})
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	// without fallback
+	{
+		w := serve("/app/settings")
+		assertEq(t, 404, w.Code)
+	}
+	router.NotFound(func(req Request) Response {
+		return NewHtmlResponse("<html>spa</html>")
+	})
+	// registered route still matches
+	{
+		w := serve("/api/users")
+		assertEq(t, 200, w.Code)
+		assertEq(t, `["joe"]`, w.Body.String())
+	}
+	// unknown path is served by fallback
+	{
+		w := serve("/app/settings")
+		assertEq(t, 200, w.Code)
+		assertEq(t, "<html>spa</html>", w.Body.String())
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter(NewResponseRenderer(NewNullTemplateLoader()))
+	router.Handle("GET /user/new", func(req Request) Response {
+		return NewStringResponse("new user form")
+	})
+	router.Handle("GET /user/:id", func(req Request) Response {
+		return NewStringResponse("user " + req.Param("id"))
+	})
+	router.Handle("POST /user/:id", func(req Request) Response {
+		return NewStringResponse("saved user " + req.Param("id"))
+	})
+	router.Handle("/user/:id/posts/:post", func(req Request) Response {
+		return NewStringResponse("user " + req.Param("id") + " post " + req.Param("post") + " unknown " + req.Param("unknown"))
+	})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	// first matching route wins
+	{
+		w := serve("GET", "/user/new")
+		assertEq(t, 200, w.Code)
+		assertEq(t, "new user form", w.Body.String())
+	}
+	// path parameters
+	{
+		w := serve("GET", "/user/42")
+		assertEq(t, 200, w.Code)
+		assertEq(t, "user 42", w.Body.String())
+		w = serve("POST", "/user/42")
+		assertEq(t, 200, w.Code)
+		assertEq(t, "saved user 42", w.Body.String())
+		w = serve("DELETE", "/user/42/posts/7")
+		assertEq(t, 200, w.Code)
+		assertEq(t, "user 42 post 7 unknown ", w.Body.String())
+	}
+	// GET routes match HEAD
+	{
+		w := serve("HEAD", "/user/42")
+		assertEq(t, 200, w.Code)
+	}
+	// method not allowed
+	{
+		w := serve("DELETE", "/user/42")
+		assertEq(t, 405, w.Code)
+		assertEq(t, "GET, POST", w.Header().Get("Allow"))
+		// methods of several matching routes are listed once
+		w = serve("DELETE", "/user/new")
+		assertEq(t, 405, w.Code)
+		assertEq(t, "GET, POST", w.Header().Get("Allow"))
+	}
+	// not found
+	{
+		assertEq(t, 404, serve("GET", "/user/").Code)
+		assertEq(t, 404, serve("GET", "/user/42/more").Code)
+		assertEq(t, 404, serve("GET", "/").Code)
+	}
+	// no path parameters without router
+	{
+		req := NewRequest(httptest.NewRequest("GET", "/user/42", nil))
+		assertEq(t, "", req.Param("id"))
+	}
+	// replace handler
+	{
+		router.Handle("GET /user/new", func(req Request) Response {
+			return NewStringResponse("replaced")
+		})
+		assertEq(t, "replaced", serve("GET", "/user/new").Body.String())
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	router := NewRouter(NewResponseRenderer(NewNullTemplateLoader()))
+	handler := func(req Request) Response {
+		return NewStringResponse(req.Method() + " " + req.Param("id") + " " + req.PostForm("name"))
+	}
+	router.Handle("POST /user/:id", handler)
+	router.Handle("PUT /user/:id", handler)
+	router.Handle("DELETE /user/:id", handler)
+	serve := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/user/42", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	// disabled by default
+	assertEq(t, "POST 42 joe", serve("_method=PUT&name=joe").Body.String())
+	router.MethodOverride = true
+	// enabled
+	assertEq(t, "PUT 42 joe", serve("_method=PUT&name=joe").Body.String())
+	assertEq(t, "DELETE 42 ", serve("_method=delete").Body.String())
+	assertEq(t, 405, serve("_method=PATCH").Code)
+	// invalid overrides are ignored
+	assertEq(t, "POST 42 ", serve("_method=GET").Body.String())
+	assertEq(t, "POST 42 ", serve("").Body.String())
+	// multipart form
+	{
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("_method", "PUT")
+		mw.WriteField("name", "jim")
+		mw.Close()
+		r := httptest.NewRequest("POST", "/user/7", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assertEq(t, "PUT 7 jim", w.Body.String())
+	}
+	// only POST is overridden
+	{
+		r := httptest.NewRequest("PUT", "/user/42?_method=DELETE", strings.NewReader("_method=DELETE"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assertEq(t, "PUT 42 ", w.Body.String())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(req Request, next func(Request) Response) Response {
+			calls = append(calls, name+" before")
+			res := next(req)
+			calls = append(calls, name+" after")
+			return res.WithHeader("X-"+name, "1")
+		}
+	}
+	auth := func(req Request, next func(Request) Response) Response {
+		if req.Header("Authorization") == "" {
+			return NewStatusResponse(401, "unauthorized")
+		}
+		return next(req)
+	}
+	handler := func(req Request) Response {
+		calls = append(calls, "handler")
+		return NewStringResponse("ok")
+	}
+	// order
+	{
+		calls = nil
+		res := Chain(handler, trace("A"), trace("B"))(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		assertEq(t, "A before,B before,handler,B after,A after", strings.Join(calls, ","))
+		assertEq(t, "1", res.Headers["X-A"])
+		assertEq(t, "1", res.Headers["X-B"])
+	}
+	// no middlewares
+	{
+		calls = nil
+		res := Chain(handler)(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		assertEq(t, "handler", strings.Join(calls, ","))
+		assertEq(t, "ok", string(res.ContentData))
+	}
+	// router with short-circuit
+	{
+		router := NewRouter(NewResponseRenderer(NewNullTemplateLoader()))
+		router.Use(trace("A"), auth)
+		router.Handle("/", handler)
+		calls = nil
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assertEq(t, 401, w.Code)
+		assertEq(t, "1", w.Header().Get("X-A"))
+		assertEq(t, "A before,A after", strings.Join(calls, ","))
+		calls = nil
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer x")
+		router.ServeHTTP(w, r)
+		assertEq(t, 200, w.Code)
+		assertEq(t, "A before,handler,A after", strings.Join(calls, ","))
+	}
+	// recover
+	{
+		var logbuf bytes.Buffer
+		log.SetOutput(&logbuf)
+		defer log.SetOutput(os.Stderr)
+		res := Chain(func(req Request) Response {
+			panic("boom")
+		}, RecoverMiddleware)(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		assertEq(t, 500, res.StatusCode)
+		assertEq(t, true, strings.Contains(logbuf.String(), "boom"))
+	}
+}
+
+func TestFormFileLimit(t *testing.T) {
+	defer func(size int64) { MaxUploadSize = size }(MaxUploadSize)
+	MaxUploadSize = 1000
+	newRequest := func(size int, contentLength bool) Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		assertEq(t, nil, mw.WriteField("title", "data"))
+		fw, err := mw.CreateFormFile("upload", "data.bin")
+		assertEq(t, nil, err)
+		fw.Write(bytes.Repeat([]byte("x"), size))
+		assertEq(t, nil, mw.Close())
+		r := httptest.NewRequest("POST", "/", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if !contentLength {
+			r.ContentLength = -1
+		}
+		return NewRequest(r)
+	}
+	// small upload
+	{
+		file, err := newRequest(100, true).FormFile("upload")
+		assertEq(t, nil, err)
+		assertEq(t, "data.bin", file.Filename())
+		assertEq(t, int64(100), file.Size())
+		file.Close()
+	}
+	// too large by content length
+	{
+		_, err := newRequest(2000, true).FormFile("upload")
+		assertEq(t, true, errors.Is(err, ErrBodyTooLarge))
+	}
+	// too large without content length
+	{
+		_, err := newRequest(2000, false).FormFile("upload")
+		assertEq(t, true, errors.Is(err, ErrBodyTooLarge))
+	}
+	// missing file
+	{
+		_, err := newRequest(100, true).FormFile("other")
+		assertEq(t, http.ErrMissingFile, err)
+	}
+	// form fields of a small upload
+	{
+		req := newRequest(100, true)
+		assertEq(t, "data", req.PostForm("title"))
+		file, err := req.FormFile("upload")
+		assertEq(t, nil, err)
+		assertEq(t, int64(100), file.Size())
+		file.Close()
+	}
+	// reading form fields first does not skip the limit
+	for _, contentLength := range []bool{true, false} {
+		req := newRequest(5000, contentLength)
+		assertEq(t, "", req.PostForm("title"))
+		_, err := req.FormFile("upload")
+		assertEq(t, true, errors.Is(err, ErrBodyTooLarge))
+		req = newRequest(5000, contentLength)
+		assertEq(t, 0, len(req.PostFormAll("title")))
+		var form struct {
+			Title string `form:"title"`
+		}
+		err = req.BindForm(&form)
+		assertEq(t, true, errors.Is(err, ErrBodyTooLarge))
+	}
+}
+
+func TestMethod(t *testing.T) {
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		req := NewRequest(httptest.NewRequest(method, "/", nil))
+		assertEq(t, method, req.Method())
+		assertEq(t, method == "GET", req.IsGet())
+		assertEq(t, method == "POST", req.IsPost())
+		assertEq(t, method == "PUT", req.IsPut())
+		assertEq(t, method == "PATCH", req.IsPatch())
+		assertEq(t, method == "DELETE", req.IsDelete())
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	var logbuf bytes.Buffer
+	log.SetOutput(&logbuf)
+	defer log.SetOutput(os.Stderr)
+	// stream and close
+	{
+		reader := &fakeReadCloser{Reader: strings.NewReader("a large report")}
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewStreamResponse(reader, "text/csv"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/csv", w.Header().Get("Content-Type"))
+		assertEq(t, "a large report", w.Body.String())
+		assertEq(t, true, reader.closed)
+	}
+	// copy error after headers are sent
+	{
+		reader := &fakeReadCloser{Reader: io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("disk failed")))}
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), NewStreamResponse(reader, "text/plain"))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "partial", w.Body.String())
+		assertEq(t, true, reader.closed)
+		assertEq(t, true, strings.Contains(logbuf.String(), "disk failed"))
+	}
+}
+
+func TestRawQuery(t *testing.T) {
+	req := NewRequest(httptest.NewRequest("GET", "/?z=1&a=%7e&b=x+y&a=2", nil))
+	assertEq(t, "z=1&a=%7e&b=x+y&a=2", req.RawQuery())
+	assertEq(t, "~", req.Query("a"))
+	assertEq(t, "", NewRequest(httptest.NewRequest("GET", "/", nil)).RawQuery())
+}
+
+func TestSessionManagerWrap(t *testing.T) {
+	store := &countingSessionStore{SessionStore: NewMemorySessionStore()}
+	manager := NewSessionManager(store, "SID", 0)
+	newRequest := func(sessionId string) Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if sessionId != "" {
+			r.AddCookie(&http.Cookie{Name: "SID", Value: sessionId})
+		}
+		return NewRequest(r)
+	}
+	// many mutations, one save
+	var sessionId string
+	{
+		handler := manager.Wrap(func(req Request, session *Session) Response {
+			*session = session.WithValue("a", "1")
+			*session = session.WithValue("b", "2")
+			*session = session.WithValue("c", "3")
+			return NewRedirectResponse("/")
+		})
+		res := handler(newRequest(""))
+		assertEq(t, 1, store.saves)
+		assertEq(t, 1, len(res.Cookies))
+		sessionId = res.Cookies[0].Value
+		assertEq(t, "a,b,c", strings.Join(store.Find(sessionId).Keys(), ","))
+	}
+	// no mutation, no save
+	{
+		handler := manager.Wrap(func(req Request, session *Session) Response {
+			assertEq(t, "1", session.Get("a", ""))
+			*session = session.WithValue("a", "1") // same value
+			return NewStringResponse("ok")
+		})
+		res := handler(newRequest(sessionId))
+		assertEq(t, 1, store.saves)
+		assertEq(t, 0, len(res.Cookies))
+		readOnly := manager.Wrap(func(req Request, session *Session) Response {
+			return NewStringResponse(session.Get("a", ""))
+		})
+		res = readOnly(newRequest(""))
+		assertEq(t, 1, store.saves)
+		assertEq(t, 0, len(res.Cookies))
+	}
+	// mutation of existing session
+	{
+		handler := manager.Wrap(func(req Request, session *Session) Response {
+			*session = session.WithoutValue("a")
+			*session = session.WithValue("d", "4")
+			return NewStringResponse("ok")
+		})
+		handler(newRequest(sessionId))
+		assertEq(t, 2, store.saves)
+		assertEq(t, "b,c,d", strings.Join(store.Find(sessionId).Keys(), ","))
+	}
+	// zero session deletes
+	{
+		handler := manager.Wrap(func(req Request, session *Session) Response {
+			*session = Session{}
+			return NewStringResponse("ok")
+		})
+		res := handler(newRequest(sessionId))
+		assertEq(t, true, store.Find(sessionId).IsZero())
+		assertEq(t, -1, res.Cookies[0].MaxAge)
+	}
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	store, err := NewCookieSessionStore(bytes.Repeat([]byte("k"), 32), "SID", time.Hour)
+	assertEq(t, nil, err)
+	newRequest := func(res Response) Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range res.Cookies {
+			r.AddCookie(c)
+		}
+		return NewRequest(r)
+	}
+	// no cookie
+	assertEq(t, true, store.Find(newRequest(Response{})).IsZero())
+	// save and find
+	session := NewSessionWithTTL(time.Hour).WithValue("name", "joe")
+	res, err := store.Save(NewRedirectResponse("/"), session)
+	assertEq(t, nil, err)
+	{
+		assertEq(t, 1, len(res.Cookies))
+		assertEq(t, "SID", res.Cookies[0].Name)
+		assertEq(t, true, res.Cookies[0].HttpOnly)
+		assertEq(t, false, strings.Contains(res.Cookies[0].Value, "joe"))
+		found := store.Find(newRequest(res))
+		assertEq(t, session.Id(), found.Id())
+		assertEq(t, "joe", found.Get("name", ""))
+		assertEq(t, session.ExpiresAt().UnixMilli(), found.ExpiresAt().UnixMilli())
+	}
+	// tampered and expired cookies
+	{
+		tampered := Response{}.WithCookie("SID", res.Cookies[0].Value[1:], time.Hour)
+		assertEq(t, true, store.Find(newRequest(tampered)).IsZero())
+		expired, err := store.Save(Response{}, NewSessionWithTTL(-time.Second))
+		assertEq(t, nil, err)
+		assertEq(t, true, store.Find(newRequest(expired)).IsZero())
+	}
+	// too large
+	{
+		_, err := store.Save(Response{}, session.WithValue("big", strings.Repeat("x", 4000)))
+		assertEq(t, true, errors.Is(err, ErrSessionTooLarge))
+	}
+	// delete
+	{
+		res := store.Delete(Response{})
+		assertEq(t, -1, res.Cookies[0].MaxAge)
+	}
+	// wrap
+	{
+		handler := store.Wrap(func(req Request, session *Session) Response {
+			*session = session.WithInt("count", session.GetInt("count", 0)+1)
+			return NewStringResponse("ok")
+		})
+		res := handler(newRequest(Response{}))
+		res = handler(newRequest(res))
+		assertEq(t, 2, store.Find(newRequest(res)).GetInt("count", 0))
+	}
+}
+
+func TestSessionManagerUpdate(t *testing.T) {
+	store := NewMemorySessionStore()
+	manager := NewSessionManager(store, "SID", time.Hour)
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	setName := func(name string) func(Session) Session {
+		return func(session Session) Session {
+			return session.WithValue("name", name)
+		}
+	}
+	// new session
+	var id string
+	{
+		req := NewTestRequest("POST", "/")
+		rec := renderer.Record(nil, manager.Update(req, NewRedirectResponse("/"), setName("joe")))
+		assertEq(t, nil, rec.AssertRedirect("/"))
+		cookie := rec.Cookie("SID")
+		assertEq(t, true, cookie != nil)
+		assertEq(t, 3600, cookie.MaxAge)
+		assertEq(t, true, cookie.HttpOnly)
+		id = cookie.Value
+		assertEq(t, "joe", store.Find(id).Get("name", ""))
+	}
+	// existing session
+	{
+		req := NewTestRequest("POST", "/").WithCookie("SID", id)
+		rec := renderer.Record(nil, manager.Update(req, NewRedirectResponse("/"), setName("ann")))
+		assertEq(t, id, rec.Cookie("SID").Value)
+		assertEq(t, "ann", store.Find(id).Get("name", ""))
+		assertEq(t, 1, len(store.FindAll()))
+		// unchanged session sets no cookie
+		rec = renderer.Record(nil, manager.Update(req, NewRedirectResponse("/"), setName("ann")))
+		assertEq(t, true, rec.Cookie("SID") == nil)
+	}
+	// rotation
+	{
+		req := NewTestRequest("POST", "/login").WithCookie("SID", id)
+		rec := renderer.Record(nil, manager.Update(req, NewRedirectResponse("/"), func(session Session) Session {
+			regenerated, err := session.Regenerate()
+			assertEq(t, nil, err)
+			return regenerated.WithValue("user", "ann")
+		}))
+		newId := rec.Cookie("SID").Value
+		assertEq(t, true, newId != id)
+		assertEq(t, true, store.Find(id).IsZero())
+		assertEq(t, "ann", store.Find(newId).Get("name", ""))
+		id = newId
+	}
+	// delete
+	{
+		req := NewTestRequest("POST", "/logout").WithCookie("SID", id)
+		rec := renderer.Record(nil, manager.Update(req, NewRedirectResponse("/"), func(Session) Session {
+			return Session{}
+		}))
+		assertEq(t, "", rec.Cookie("SID").Value)
+		assertEq(t, true, store.Find(id).IsZero())
+	}
+}
+
+func TestSessionIdle(t *testing.T) {
+	// touch and idle
+	{
+		session := NewSession()
+		assertEq(t, true, session.LastAccessedAt().IsZero())
+		assertEq(t, false, session.IsIdle(time.Minute))
+		assertEq(t, true, session.IsIdle(0))
+		session.created = time.Now().Add(-time.Hour)
+		assertEq(t, true, session.IsIdle(30*time.Minute))
+		touched := session.Touch()
+		assertEq(t, false, touched.IsIdle(30*time.Minute))
+		assertEq(t, true, session.LastAccessedAt().IsZero())
+		assertEq(t, false, touched.Equal(session))
+	}
+	// persisted in file store, find does not touch
+	{
+		filename := filepath.Join(t.TempDir(), "sessions.json")
+		store, err := NewFileSessionStore(filename)
+		assertEq(t, nil, err)
+		session := NewSession()
+		session.accessed = time.Now().Add(-time.Hour)
+		assertEq(t, nil, store.Save(session))
+		store, err = NewFileSessionStore(filename)
+		assertEq(t, nil, err)
+		found := store.Find(session.Id())
+		assertEq(t, session.LastAccessedAt().UnixMilli(), found.LastAccessedAt().UnixMilli())
+		assertEq(t, true, store.Find(session.Id()).IsIdle(30*time.Minute))
+	}
+	// session manager
+	{
+		store := &countingSessionStore{SessionStore: NewMemorySessionStore()}
+		manager := NewSessionManager(store, "SID", 0)
+		manager.IdleTimeout = 30 * time.Minute
+		handler := manager.Wrap(func(req Request, session *Session) Response {
+			return NewStringResponse(session.Get("name", ""))
+		})
+		newRequest := func(id string) Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "SID", Value: id})
+			return NewRequest(r)
+		}
+		active := NewSession().WithValue("name", "joe").Touch()
+		assertEq(t, nil, store.Save(active))
+		idle := NewSession().WithValue("name", "jim")
+		idle.accessed = time.Now().Add(-time.Hour)
+		assertEq(t, nil, store.Save(idle))
+		idle2 := NewSession().WithValue("name", "jack")
+		idle2.accessed = time.Now().Add(-time.Hour)
+		assertEq(t, nil, store.Save(idle2))
+		// active session is touched and saved
+		store.saves = 0
+		res := handler(newRequest(active.Id()))
+		assertEq(t, "joe", string(res.ContentData))
+		assertEq(t, 1, store.saves)
+		assertEq(t, true, store.Find(active.Id()).LastAccessedAt().After(active.LastAccessedAt()))
+		// idle session is not found and deleted
+		assertEq(t, false, store.Find(idle.Id()).IsZero())
+		assertEq(t, true, manager.Find(newRequest(idle.Id())).IsZero())
+		assertEq(t, true, store.Find(idle.Id()).IsZero())
+		res = handler(newRequest(idle2.Id()))
+		assertEq(t, "", string(res.ContentData))
+		assertEq(t, true, store.Find(idle2.Id()).IsZero())
+		// new unchanged session is not saved
+		assertEq(t, 1, store.saves)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var entries []AccessLogEntry
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	renderer.AccessLog = func(entry AccessLogEntry) {
+		entries = append(entries, entry)
+	}
+	render := func(r *http.Request, res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		return w
+	}
+	// content
+	{
+		r := httptest.NewRequest("GET", "/hello", nil)
+		render(r, NewStringResponse("hello"))
+		assertEq(t, 1, len(entries))
+		assertEq(t, r, entries[0].Request)
+		assertEq(t, ContentResponse, entries[0].ResponseType)
+		assertEq(t, 200, entries[0].StatusCode)
+		assertEq(t, int64(5), entries[0].Bytes)
+		assertEq(t, true, entries[0].Duration >= 0)
+	}
+	// status
+	{
+		render(httptest.NewRequest("GET", "/", nil), NewStatusNotFoundResponse("not found"))
+		assertEq(t, StatusResponse, entries[1].ResponseType)
+		assertEq(t, 404, entries[1].StatusCode)
+		assertEq(t, int64(9), entries[1].Bytes)
+	}
+	// negotiated
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", "application/json")
+		render(r, NewNegotiatedResponse("index.html", M{}))
+		assertEq(t, JsonResponse, entries[2].ResponseType)
+		assertEq(t, 200, entries[2].StatusCode)
+	}
+	// duration since start time
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), startTimeKey, time.Now().Add(-time.Second)))
+		render(r, NewNoContentResponse())
+		assertEq(t, 204, entries[3].StatusCode)
+		assertEq(t, true, entries[3].Duration >= time.Second)
+	}
+	// streaming responses are still flushed
+	{
+		records := make(chan any, 1)
+		records <- 1
+		close(records)
+		w := render(httptest.NewRequest("GET", "/", nil), NewJsonLinesResponse(records))
+		assertEq(t, true, w.Flushed)
+		assertEq(t, int64(2), entries[4].Bytes)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	var entry AccessLogEntry
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	renderer.AccessLog = func(e AccessLogEntry) {
+		entry = e
+	}
+	render := func(r *http.Request, res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		assertEq(t, w.Code, entry.StatusCode)
+		assertEq(t, int64(w.Body.Len()), entry.Bytes)
+		return w
+	}
+	// error handlers
+	{
+		renderer.ErrorHandler = func(w http.ResponseWriter, req *http.Request, msg string) {
+			w.WriteHeader(503)
+			io.WriteString(w, "sorry")
+		}
+		renderer.NotFoundHandler = func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "<h1>not here</h1>")
+		}
+		render(httptest.NewRequest("GET", "/", nil), NewStatusInternalServerErrorResponse("boom"))
+		assertEq(t, 503, entry.StatusCode)
+		render(httptest.NewRequest("GET", "/", nil), NewStatusNotFoundResponse("none"))
+		assertEq(t, 200, entry.StatusCode)
+		render(httptest.NewRequest("GET", "/", nil), NewTemplateResponse("missing.html", nil))
+		assertEq(t, 503, entry.StatusCode)
+	}
+	// conditional and range requests
+	{
+		res := NewStringResponse("0123456789")
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=0-3")
+		render(r, res)
+		assertEq(t, 206, entry.StatusCode)
+		assertEq(t, int64(4), entry.Bytes)
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", contentEtag([]byte("0123456789")))
+		render(r, res)
+		assertEq(t, 304, entry.StatusCode)
+		assertEq(t, int64(0), entry.Bytes)
+	}
+	// redirect and nothing written
+	{
+		render(httptest.NewRequest("GET", "/", nil), NewPermanentRedirectResponse("/"))
+		assertEq(t, 301, entry.StatusCode)
+		render(httptest.NewRequest("GET", "/", nil), NewStatusResponse(200, ""))
+		assertEq(t, 200, entry.StatusCode)
+	}
+	// response controller
+	{
+		w := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		assertEq(t, nil, http.NewResponseController(w).Flush())
+	}
+}
+
+func TestTemplateError(t *testing.T) {
+	tpl := template.Must(template.New("page.html").Parse(`<h1>Title</h1>{{.user.Name}}`))
+	renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// error mid-execution: nothing of the page is sent
+	{
+		w := render(NewTemplateResponse("page.html", M{"user": 42}))
+		assertEq(t, 500, w.Code)
+		assertEq(t, false, strings.Contains(w.Body.String(), "<h1>"))
+		assertEq(t, true, strings.Contains(w.Body.String(), "cannot render page.html"))
+	}
+	// buffers are reused without leaking content
+	{
+		type user struct{ Name string }
+		for _, name := range []string{"a long name", "b"} {
+			w := render(NewTemplateResponse("page.html", M{"user": user{name}}).WithStatus(201))
+			assertEq(t, 201, w.Code)
+			assertEq(t, "<h1>Title</h1>"+name, w.Body.String())
+		}
+	}
+}
+
+func TestWithTemplateFuncs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"form.html": {Data: []byte(`<form>{{csrfField}}</form>`)},
+	}
+	funcs := template.FuncMap{"csrfField": func() template.HTML { return "" }}
+	loader, err := NewFSTemplateLoader(fsys, "*.html", funcs)
+	assertEq(t, nil, err)
+	renderer := NewResponseRenderer(loader)
+	render := func(res Response) string {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w.Body.String()
+	}
+	csrfField := func(token string) template.FuncMap {
+		return template.FuncMap{"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="csrf" value="` + template.HTMLEscapeString(token) + `">`)
+		}}
+	}
+	assertEq(t, `<form></form>`, render(NewTemplateResponse("form.html", nil)))
+	assertEq(t, `<form><input type="hidden" name="csrf" value="abc"></form>`, render(NewTemplateResponse("form.html", nil).WithTemplateFuncs(csrfField("abc"))))
+	assertEq(t, `<form><input type="hidden" name="csrf" value="xyz"></form>`, render(NewTemplateResponse("form.html", nil).WithTemplateFuncs(csrfField("xyz"))))
+	// cached templates are not affected
+	assertEq(t, `<form></form>`, render(NewTemplateResponse("form.html", nil)))
+}
+
+func TestDefaultTemplateLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "index.html")
+	assertEq(t, nil, os.WriteFile(filename, []byte("version 1"), 0644))
+	loader, err := NewDefaultTemplateLoader(filepath.Join(dir, "*.html"), nil, true)
+	assertEq(t, nil, err)
+	render := func(tpl *template.Template) string {
+		var buf bytes.Buffer
+		assertEq(t, nil, tpl.ExecuteTemplate(&buf, "index.html", nil))
+		return buf.String()
+	}
+	tpl1, err := loader.Load()
+	assertEq(t, nil, err)
+	assertEq(t, "version 1", render(tpl1))
+	// no reparse when nothing changed
+	tpl2, err := loader.Load()
+	assertEq(t, nil, err)
+	assertEq(t, tpl1, tpl2)
+	// reparse when a file was modified
+	assertEq(t, nil, os.WriteFile(filename, []byte("version 2"), 0644))
+	future := time.Now().Add(time.Minute)
+	assertEq(t, nil, os.Chtimes(filename, future, future))
+	tpl3, err := loader.Load()
+	assertEq(t, nil, err)
+	assertEq(t, true, tpl1 != tpl3)
+	assertEq(t, "version 2", render(tpl3))
+	// reparse when a file was added
+	assertEq(t, nil, os.WriteFile(filepath.Join(dir, "other.html"), []byte("other"), 0644))
+	tpl4, err := loader.Load()
+	assertEq(t, nil, err)
+	assertEq(t, true, tpl3 != tpl4)
+	assertEq(t, true, tpl4.Lookup("other.html") != nil)
+	// clones are fresh copies
+	clone, err := loader.(TemplateCloner).Clone()
+	assertEq(t, nil, err)
+	assertEq(t, "version 2", render(clone))
+}
+
+func TestMinifyHtml(t *testing.T) {
+	minify := func(html string) string {
+		return string(MinifyHtml([]byte(html)))
+	}
+	assertEq(t, "", minify(""))
+	assertEq(t, "<p>Hello World</p>", minify("<p>Hello World</p>"))
+	// whitespace and comments
+	assertEq(t, "<html> <body> <p>Hello World</p> </body> </html> ", minify("<html>\n  <body>\n    <p>Hello   \t World</p>\n  </body>\n</html>\n"))
+	assertEq(t, "<p>a b</p>", minify("<p>a <!-- a comment --> b</p>"))
+	assertEq(t, "<p>a<!-- unterminated\n  <b>b</b>", minify("<p>a<!-- unterminated\n  <b>b</b>"))
+	assertEq(t, "<p>a</p> <!-- x", minify("<p>a</p>\n <!-- x"))
+	// tags and attributes
+	assertEq(t, `<a href="/x" title="a   b" class='c  d'>x</a>`, minify("<a \n  href=\"/x\"  title=\"a   b\"\tclass='c  d'>x</a>"))
+	assertEq(t, "<!DOCTYPE html> <h1>x</h1>", minify("<!DOCTYPE html>\n\n<h1>x</h1>"))
+	assertEq(t, "a &lt; b < c", minify("a  &lt;  b  <  c"))
+	// raw text elements are kept
+	assertEq(t, "<pre>\n  a\n    b\n</pre> <p>c</p>", minify("<pre>\n  a\n    b\n</pre>\n  <p>c</p>"))
+	assertEq(t, "<textarea name=\"t\">  x  </TEXTAREA>", minify("<textarea  name=\"t\">  x  </TEXTAREA>"))
+	assertEq(t, "<script>\nvar a = 1;  // <!-- x -->\n</script>", minify("<script>\nvar a = 1;  // <!-- x -->\n</script>"))
+	assertEq(t, "<style>p  { color: red }</style>", minify("<style>p  { color: red }</style>"))
+	assertEq(t, "<pre>  unterminated", minify("<pre>  unterminated"))
+	assertEq(t, "<pre-x> a </pre-x>", minify("<pre-x>  a  </pre-x>"))
+	// renderer
+	{
+		tpl := template.Must(template.New("index.html").Parse("<div>\n  <p>{{.name}}</p>\n  <pre>  {{.name}}  </pre>\n</div>\n"))
+		renderer := NewResponseRenderer(&fakeTemplateLoader{tpl})
+		body, _, err := renderer.RenderToString(NewTemplateResponse("index.html", M{"name": "joe"}))
+		assertEq(t, nil, err)
+		assertEq(t, "<div>\n  <p>joe</p>\n  <pre>  joe  </pre>\n</div>\n", body)
+		renderer.MinifyHtml = true
+		body, _, err = renderer.RenderToString(NewTemplateResponse("index.html", M{"name": "joe"}))
+		assertEq(t, nil, err)
+		assertEq(t, "<div> <p>joe</p> <pre>  joe  </pre> </div> ", body)
+		// other content types are not minified
+		body, _, err = renderer.RenderToString(NewTemplateResponse("index.html", M{"name": "joe"}).WithHeader("Content-Type", "text/plain"))
+		assertEq(t, nil, err)
+		assertEq(t, "<div>\n  <p>joe</p>\n  <pre>  joe  </pre>\n</div>\n", body)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	dir := t.TempDir()
+	content := `<a href="/user?name={{.name}}" title="{{.name}}">{{.name}}</a><script>var name = {{.name}};</script>`
+	assertEq(t, nil, os.WriteFile(filepath.Join(dir, "user.html"), []byte(content), 0644))
+	loader, err := NewDefaultTemplateLoader(filepath.Join(dir, "*.html"), nil, false)
+	assertEq(t, nil, err)
+	// user data is escaped according to its context
+	{
+		out, err := RenderTemplate(loader, "user.html", M{"name": `<b>"joe" & 'ann'</b>`})
+		assertEq(t, nil, err)
+		exp := `<a href="/user?name=%3cb%3e%22joe%22%20%26%20%27ann%27%3c%2fb%3e" title="&lt;b&gt;&#34;joe&#34; &amp; &#39;ann&#39;&lt;/b&gt;">&lt;b&gt;&#34;joe&#34; &amp; &#39;ann&#39;&lt;/b&gt;</a><script>var name = "\u003cb\u003e\"joe\" \u0026 'ann'\u003c/b\u003e";</script>`
+		assertEq(t, exp, out)
+	}
+	// errors
+	{
+		_, err := RenderTemplate(loader, "none.html", nil)
+		assertEq(t, true, err != nil)
+		_, err = RenderTemplate(NewNullTemplateLoader(), "user.html", nil)
+		assertEq(t, true, err != nil)
+	}
+}
+
+func TestDefaultTemplateLoaderMulti(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		filename := filepath.Join(dir, name)
+		assertEq(t, nil, os.MkdirAll(filepath.Dir(filename), 0755))
+		assertEq(t, nil, os.WriteFile(filename, []byte(content), 0644))
+	}
+	writeFile("pages/index.html", `index {{template "header.html"}}`)
+	writeFile("partials/header.html", `header`)
+	writeFile("emails/welcome.html", `welcome`)
+	patterns := []string{
+		filepath.Join(dir, "pages", "*.html"),
+		filepath.Join(dir, "partials", "*.html"),
+		filepath.Join(dir, "emails", "*.html"),
+	}
+	for _, reload := range []bool{false, true} {
+		loader, err := NewDefaultTemplateLoaderMulti(patterns, nil, reload)
+		assertEq(t, nil, err)
+		tpl, err := loader.Load()
+		assertEq(t, nil, err)
+		var buf bytes.Buffer
+		assertEq(t, nil, tpl.ExecuteTemplate(&buf, "index.html", nil))
+		assertEq(t, "index header", buf.String())
+		assertEq(t, true, tpl.Lookup("welcome.html") != nil)
+	}
+	// duplicate template names
+	writeFile("emails/header.html", `email header`)
+	_, err := NewDefaultTemplateLoaderMulti(patterns, nil, false)
+	assertEq(t, true, err != nil)
+	assertEq(t, true, strings.Contains(err.Error(), `duplicate template "header.html"`))
+	// pattern without files
+	_, err = NewDefaultTemplateLoaderMulti([]string{filepath.Join(dir, "none", "*.html")}, nil, false)
+	assertEq(t, true, err != nil)
+}
+
+func TestEtag(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		return w
+	}
+	// content response
+	{
+		res := NewContentResponse([]byte("<svg/>"), "image/svg+xml", "")
+		w := render(res, "")
+		assertEq(t, 200, w.Code)
+		etag := w.Header().Get("Etag")
+		assertEq(t, 34, len(etag))
+		assertEq(t, "<svg/>", w.Body.String())
+		// same content, same etag
+		assertEq(t, etag, render(res, "").Header().Get("Etag"))
+		// different content, different etag
+		assertEq(t, true, etag != render(NewStringResponse("<svg></svg>"), "").Header().Get("Etag"))
+		// if-none-match
+		w = render(res, etag)
+		assertEq(t, 304, w.Code)
+		assertEq(t, "", w.Body.String())
+		w = render(res, `"other"`)
+		assertEq(t, 200, w.Code)
+		// etag set by handler
+		w = render(res.WithHeader("ETag", `"v1"`), `"v1"`)
+		assertEq(t, 304, w.Code)
+	}
+	// file response
+	{
+		filename := filepath.Join(t.TempDir(), "data.txt")
+		assertEq(t, nil, os.WriteFile(filename, []byte("hello"), 0644))
+		res := NewFileResponse(filename, "text/plain", "")
+		w := render(res, "")
+		assertEq(t, 200, w.Code)
+		etag := w.Header().Get("Etag")
+		assertEq(t, true, strings.HasPrefix(etag, `W/"5-`))
+		assertEq(t, "hello", w.Body.String())
+		w = render(res, etag)
+		assertEq(t, 304, w.Code)
+		assertEq(t, "", w.Body.String())
+		// modified file
+		assertEq(t, nil, os.Chtimes(filename, time.Now(), time.Now().Add(time.Hour)))
+		w = render(res, etag)
+		assertEq(t, 200, w.Code)
+	}
+}
+
+func TestFileResponseFS(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	modtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"assets/report.csv": {Data: []byte("a,b,c\n1,2,3\n"), ModTime: modtime},
+		"assets/logo.txt":   {Data: []byte("0123456789")}, // like embed.FS, without modtime
+	}
+	render := func(res Response, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		renderer.Render(w, r, res)
+		return w
+	}
+	// with modtime
+	{
+		res := NewFileResponseFS(fsys, "assets/report.csv", "", "attachment")
+		w := render(res, nil)
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assertEq(t, "attachment", w.Header().Get("Content-Disposition"))
+		assertEq(t, modtime.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+		assertEq(t, "a,b,c\n1,2,3\n", w.Body.String())
+		etag := w.Header().Get("Etag")
+		assertEq(t, true, strings.HasPrefix(etag, `W/"c-`))
+		assertEq(t, 304, render(res, map[string]string{"If-None-Match": etag}).Code)
+		assertEq(t, 304, render(res, map[string]string{"If-Modified-Since": modtime.Format(http.TimeFormat)}).Code)
+	}
+	// without modtime, etag from content, range request
+	{
+		res := NewFileResponseFS(fsys, "assets/logo.txt", "text/x-logo", "")
+		w := render(res, nil)
+		assertEq(t, 200, w.Code)
+		assertEq(t, "text/x-logo", w.Header().Get("Content-Type"))
+		assertEq(t, "", w.Header().Get("Last-Modified"))
+		etag := w.Header().Get("Etag")
+		assertEq(t, contentEtag([]byte("0123456789")), etag)
+		assertEq(t, 304, render(res, map[string]string{"If-None-Match": etag}).Code)
+		w = render(res, map[string]string{"Range": "bytes=2-4"})
+		assertEq(t, 206, w.Code)
+		assertEq(t, "234", w.Body.String())
+	}
+	// without modtime, etag is hashed once per file
+	{
+		counting := &readCountingFS{MapFS: fsys}
+		res := NewFileResponseFS(counting, "assets/logo.txt", "", "")
+		w := render(res, nil)
+		assertEq(t, "0123456789", w.Body.String())
+		etag := w.Header().Get("Etag")
+		assertEq(t, contentEtag([]byte("0123456789")), etag)
+		counting.reads = 0
+		assertEq(t, 304, render(res, map[string]string{"If-None-Match": etag}).Code)
+		assertEq(t, 0, counting.reads)
+		w = render(res, nil)
+		assertEq(t, etag, w.Header().Get("Etag"))
+		assertEq(t, "0123456789", w.Body.String())
+	}
+	// not found
+	{
+		assertEq(t, 404, render(NewFileResponseFS(fsys, "assets/none.txt", "", ""), nil).Code)
+		assertEq(t, 404, render(NewFileResponseFS(fsys, "assets", "", ""), nil).Code)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	renderer := NewResponseRenderer(NewNullTemplateLoader())
+	render := func(res Response) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		renderer.Render(w, httptest.NewRequest("GET", "/", nil), res)
+		return w
+	}
+	// cache control
+	{
+		w := render(NewStringResponse("ok").WithCacheControl(time.Hour))
+		assertEq(t, 200, w.Code)
+		assertEq(t, "max-age=3600", w.Header().Get("Cache-Control"))
+		assertEq(t, "", w.Header().Get("Expires"))
+		assertEq(t, "", w.Header().Get("Pragma"))
+	}
+	// no cache
+	{
+		w := render(NewStringResponse("ok").WithNoCache())
+		assertEq(t, 200, w.Code)
+		assertEq(t, "no-cache, no-store, must-revalidate", w.Header().Get("Cache-Control"))
+		assertEq(t, "0", w.Header().Get("Expires"))
+		assertEq(t, "no-cache", w.Header().Get("Pragma"))
+	}
+	// last call wins
+	{
+		noCache := NewStringResponse("ok").WithNoCache()
+		w := render(noCache.WithCacheControl(time.Minute))
+		assertEq(t, "max-age=60", w.Header().Get("Cache-Control"))
+		assertEq(t, "", w.Header().Get("Expires"))
+		assertEq(t, "", w.Header().Get("Pragma"))
+		// the original response is not modified
+		assertEq(t, "no-cache", render(noCache).Header().Get("Pragma"))
+	}
+}
+
+// assertion helper
+
+func assertEq(t *testing.T, exp, act any) {
+	t.Helper()
+	if act != exp {
+		t.Fatalf("expected %v but was %v", exp, act)
+	}
+}
+
+// fake TemplateLoader
+
+type fakeTemplateLoader struct {
+	tpl *template.Template
+}
+
+func (l *fakeTemplateLoader) Load() (*template.Template, error) {
+	return l.tpl, nil
+}
+
+// fake Clock
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// fake io.ReadCloser
+
+type fakeReadCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (r *fakeReadCloser) Close() error {
+	r.closed = true
+	return nil
+}
+
+// fake io.ReadSeekCloser
+
+type fakeReadSeekCloser struct {
+	io.ReadSeeker
+	closed bool
+}
+
+func (r *fakeReadSeekCloser) Close() error {
+	r.closed = true
+	return nil
+}
+
+// counting SessionStore
+
+type countingSessionStore struct {
+	SessionStore
+	saves int
+}
+
+func (st *countingSessionStore) Save(session Session) error {
+	st.saves++
+	return st.SessionStore.Save(session)
+}
+
+// failing SessionStore
+
+type failingSessionStore struct {
+	SessionStore
+	failDeleteId string
+}
+
+func (st *failingSessionStore) Delete(id string) error {
+	if id == st.failDeleteId {
+		return errors.New("delete failed")
+	}
+	return st.SessionStore.Delete(id)
+}
+
+// fake SessionCleaner
+
+type fakeSessionCleaner struct {
+	SessionStore
+	running bool
+}
+
+func (st *fakeSessionCleaner) StartCleanup(interval time.Duration) {
+	st.running = true
+}
+
+func (st *fakeSessionCleaner) StopCleanup() {
+	st.running = false
+}
+
+// fake RedisClient
+
+type fakeRedisClient struct {
+	data map[string]string
+	ttls map[string]time.Duration
+	err  error
+}
+
+func (c *fakeRedisClient) Get(key string) (string, bool, error) {
+	value, ok := c.data[key]
+	return value, ok, c.err
+}
+
+func (c *fakeRedisClient) Set(key, value string, ttl time.Duration) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.data[key] = value
+	c.ttls[key] = ttl
+	return nil
+}
+
+func (c *fakeRedisClient) Del(key string) error {
+	delete(c.data, key)
+	return c.err
+}
+
+func (c *fakeRedisClient) Keys(prefix string) ([]string, error) {
+	var keys []string
+	for key := range c.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, c.err
+}
+
+// read counting fs.FS
+
+type readCountingFS struct {
+	fstest.MapFS
+	reads int
+}
+
+func (fsys *readCountingFS) Open(name string) (fs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{f, fsys}, nil
+}
+
+type readCountingFile struct {
+	fs.File
+	fsys *readCountingFS
+}
+
+func (f *readCountingFile) Read(p []byte) (int, error) {
+	f.fsys.reads++
+	return f.File.Read(p)
+}
+
+func (f *readCountingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+// failing http.ResponseWriter
+
+type failingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// form with validation
+
+type addForm struct {
+	Value1     int        `form:"value1"`
+	Value2     int        `form:"value2"`
+	Tags       []string   `form:"tag"`
+	Upload     []FormFile `form:"upload"`
+	Attachment FormFile   `form:"attachment"`
+}
+
+func (f *addForm) Validate() error {
+	if f.Value1 == 0 {
+		return errors.New("value1 is required")
+	}
+	if f.Value2 == 0 {
+		return errors.New("value2 is required")
+	}
+	return nil
+}